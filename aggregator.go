@@ -0,0 +1,45 @@
+package stackerr
+
+import (
+	"errors"
+	"sync"
+)
+
+// Aggregator collects errors (e.g. from each iteration of a loop) into a
+// single joined stackerr.Error. It is safe for concurrent use, and its zero
+// value is ready to use.
+type Aggregator struct {
+	lock sync.Mutex
+	errs []error
+}
+
+// Add adds an error to the aggregator. Nil errors are ignored.
+func (a *Aggregator) Add(err error) {
+	if err == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.errs = append(a.errs, err)
+}
+
+// Len returns the number of errors that have been added.
+func (a *Aggregator) Len() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.errs)
+}
+
+// Err returns a stackerr.Error that joins all errors that have been added, using
+// the stack trace at the point where this function was called, or nil if no errors
+// have been added. Each added error keeps its own stacks and fields, and can be
+// found with errors.Is and errors.As. The joined errors can be enumerated with
+// the Unwrap() []error method of the error that the stackerr.Error wraps.
+func (a *Aggregator) Err() Error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.errs) == 0 {
+		return nil
+	}
+	return new(errors.Join(a.errs...), 1, true)
+}
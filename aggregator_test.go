@@ -0,0 +1,62 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestAggregator(t *testing.T) {
+	agg := &Aggregator{}
+	agg.Add(nil)
+	if agg.Len() != 0 || agg.Err() != nil {
+		t.Fatal("expected no error when only nils are added")
+	}
+
+	added := make([]Error, 3)
+	for i := range added {
+		added[i] = Wrap(fmt.Errorf("item %d", i)).WithSingle("item", i)
+		agg.Add(added[i])
+		agg.Add(nil)
+	}
+	if agg.Len() != 3 {
+		t.Fatalf("expected 3 errors, got %d", agg.Len())
+	}
+
+	err := agg.Err()
+	joined, ok := err.Unwrap().(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatal("expected the joined errors to be enumerable")
+	}
+	errs := joined.Unwrap()
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 joined errors, got %d", len(errs))
+	}
+	for i, e := range errs {
+		if !errors.Is(err, added[i]) {
+			t.Fatalf("expected error %d to be found with errors.Is", i)
+		}
+		// Each error keeps its stacks and fields
+		serr := e.(Error)
+		if !serr.Stacks().Equal(added[i].Stacks()) || serr.Fields()["item"] != i {
+			t.Fatalf("expected error %d to keep its stacks and fields", i)
+		}
+	}
+}
+
+func TestAggregatorConcurrentAdd(t *testing.T) {
+	agg := &Aggregator{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			agg.Add(fmt.Errorf("item %d", i))
+		}(i)
+	}
+	wg.Wait()
+	if agg.Len() != 10 {
+		t.Fatalf("expected 10 errors, got %d", agg.Len())
+	}
+}
@@ -0,0 +1,80 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CodeField is the reserved field that Builder.Code uses to store an error code.
+const CodeField string = "code"
+
+// Builder builds a stackerr.Error from a message, fields, and a code, without
+// cloning the error for each addition. Create one with Build.
+type Builder struct {
+	err    error
+	fields map[string]any
+}
+
+// Build starts building a new stackerr.Error, for example:
+//
+//	err := stackerr.Build().Msgf("failed %d", n).Field("k", v).Code("not_found").Err()
+func Build() *Builder {
+	return &Builder{}
+}
+
+// Msg sets the message of the error being built.
+func (b *Builder) Msg(message string) *Builder {
+	b.err = errors.New(message)
+	return b
+}
+
+// Msgf sets the message of the error being built, formatted according to a format
+// specifier. As with fmt.Errorf, the %w verb can be used to wrap another error.
+func (b *Builder) Msgf(format string, a ...interface{}) *Builder {
+	b.err = fmt.Errorf(format, a...)
+	return b
+}
+
+// Field adds a key-value pair to the error being built, overwriting
+// any existing key-value pair with the same key.
+func (b *Builder) Field(key string, value any) *Builder {
+	if b.fields == nil {
+		b.fields = map[string]any{}
+	}
+	b.fields[key] = value
+	return b
+}
+
+// Fields adds key-value pairs to the error being built, overwriting
+// any existing key-value pairs with the same keys.
+func (b *Builder) Fields(keyValuePairs map[string]any) *Builder {
+	for k, v := range keyValuePairs {
+		b.Field(k, v)
+	}
+	return b
+}
+
+// Code sets the code of the error being built, which is stored in the CodeField field.
+func (b *Builder) Code(code string) *Builder {
+	return b.Field(CodeField, code)
+}
+
+// Err creates the stackerr.Error, using the stack trace at the point where this
+// function was called. The Builder can be reused afterwards, but the fields that
+// were added before calling Err will not be included in errors built later.
+func (b *Builder) Err() Error {
+	err := b.err
+	if err == nil {
+		err = errors.New("")
+	}
+	se := wrapError(err, 1, true, collapseParentStacks.Load())
+	if se.MetaFields == nil {
+		// The fields now belong to the error, so there's no need to copy them
+		se.MetaFields = b.fields
+	} else {
+		se.WithInPlace(b.fields)
+	}
+	b.fields = nil
+	runWrapHooks(se)
+	return se
+}
@@ -0,0 +1,40 @@
+package stackerr
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	base := errors.New("connection refused")
+	_, _, line, _ := runtime.Caller(0)
+	err := Build().Msgf("failed %d times: %w", 3, base).Field("user", "alice").Fields(map[string]any{"attempt": 3}).Code("not_found").Err()
+
+	if err.Error() != "failed 3 times: connection refused" || !errors.Is(err, base) {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+	fields := err.Fields()
+	if len(fields) != 3 || fields["user"] != "alice" || fields["attempt"] != 3 || fields[CodeField] != "not_found" {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	top, ok := err.Stacks()[0].Top()
+	if len(err.Stacks()) != 1 || !ok || top.Function != packageFunctionPrefix+"TestBuilder" || top.Line != line+1 {
+		t.Fatalf("expected the stack to be attributed to the Err call, got %v", err.Stacks())
+	}
+}
+
+func TestBuilderReuse(t *testing.T) {
+	b := Build().Msg("failed").Field("first", 1)
+	first := b.Err()
+	second := b.Field("second", 2).Err()
+	if _, ok := second.Fields()["first"]; ok {
+		t.Fatal("expected the fields of the first error not to be included")
+	}
+	if _, ok := first.Fields()["second"]; ok {
+		t.Fatal("expected the first error not to be changed")
+	}
+	if empty := Build().Err(); empty.Error() != "" || len(empty.Stacks()) != 1 {
+		t.Fatalf("expected an empty message with a stack, got %q", empty.Error())
+	}
+}
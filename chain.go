@@ -0,0 +1,129 @@
+package stackerr
+
+import "errors"
+
+// ChainDepth returns the number of errors in the longest chain of wrapped errors,
+// starting with (and including) `err`. Errors that wrap multiple errors (e.g. from
+// errors.Join) are followed along each of their branches. A nil error has a depth
+// of 0, and an error that doesn't wrap anything has a depth of 1.
+func ChainDepth(err error) int {
+	return chainDepth(err, nil)
+}
+
+// chainDepth gets the chain depth of an error, where `path` is the errors that
+// wrap it. An error that wraps itself (a cycle) isn't followed again.
+func chainDepth(err error, path []error) int {
+	if err == nil || onPath(path, err) {
+		return 0
+	}
+	path = append(path, err)
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		maxDepth := 0
+		for _, branch := range e.Unwrap() {
+			if depth := chainDepth(branch, path); depth > maxDepth {
+				maxDepth = depth
+			}
+		}
+		return 1 + maxDepth
+	case interface{ Unwrap() error }:
+		return 1 + chainDepth(e.Unwrap(), path)
+	}
+	return 1
+}
+
+// AllErrors returns every error in the tree of wrapped errors, starting with (and
+// including) `err`, in the same depth-first order that errors.Is and errors.As
+// traverse it. Errors that wrap multiple errors (e.g. from errors.Join) are followed
+// along each of their branches in order. A nil error results in an empty slice.
+// If the tree has a cycle (see HasCycle), each error in the cycle is only included once.
+func AllErrors(err error) []error {
+	return appendAllErrors(nil, err, nil)
+}
+
+// appendAllErrors appends every error in the tree of an error to `all`, where
+// `path` is the errors that wrap it.
+func appendAllErrors(all []error, err error, path []error) []error {
+	if err == nil || onPath(path, err) {
+		return all
+	}
+	all = append(all, err)
+	path = append(path, err)
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, branch := range e.Unwrap() {
+			all = appendAllErrors(all, branch, path)
+		}
+	case interface{ Unwrap() error }:
+		all = appendAllErrors(all, e.Unwrap(), path)
+	}
+	return all
+}
+
+// onPath checks whether an error is one of the errors on a path through a tree of errors.
+func onPath(path []error, err error) bool {
+	for _, p := range path {
+		if sameError(p, err) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCycle checks whether the tree of wrapped errors, starting with `err`, has a
+// cycle (e.g. A wraps B, which wraps A), which would make errors.Is and errors.As
+// loop forever. Errors that appear in more than one branch of a joined error
+// aren't a cycle, as long as none of them wraps itself.
+func HasCycle(err error) bool {
+	return hasCycle(err, nil)
+}
+
+// hasCycle checks whether the tree of an error has a cycle, where `joins` is the
+// errors that wrap multiple errors on the path to it. A cycle either goes through
+// one of those, or is in a chain of errors that each wrap a single error.
+func hasCycle(err error, joins []error) bool {
+	// An error that moves down the chain at half the speed, which catches up if it loops
+	slow := err
+	for i := 0; err != nil; i++ {
+		if i > 0 && sameError(err, slow) {
+			return true
+		}
+		if e, ok := err.(interface{ Unwrap() []error }); ok {
+			if onPath(joins, err) {
+				return true
+			}
+			joins = append(joins, err)
+			for _, branch := range e.Unwrap() {
+				if hasCycle(branch, joins) {
+					return true
+				}
+			}
+			return false
+		}
+		err = errors.Unwrap(err)
+		if i%2 == 1 {
+			slow = errors.Unwrap(slow)
+		}
+	}
+	return false
+}
+
+// walkChain calls `visit` with each error in the chain of wrapped errors, starting
+// with `err`, until it returns false. If the chain has a cycle, it stops once the
+// cycle is detected, which may be after some errors in the cycle are visited twice.
+func walkChain(err error, visit func(err error) bool) {
+	// An error that moves down the chain at half the speed, to detect cycles
+	slow := err
+	for i := 0; err != nil; i++ {
+		if i > 0 && sameError(err, slow) {
+			return
+		}
+		if !visit(err) {
+			return
+		}
+		err = errors.Unwrap(err)
+		if i%2 == 1 {
+			slow = errors.Unwrap(slow)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestHasCycle(t *testing.T) {
+	if HasCycle(nil) {
+		t.Fatal("nil error has no cycle")
+	}
+	base := errors.New("record not found")
+	if HasCycle(fmt.Errorf("outer: %w", Wrap(base))) {
+		t.Fatal("expected no cycle")
+	}
+	// The same error in two branches isn't a cycle
+	if HasCycle(errors.Join(base, base)) {
+		t.Fatal("expected no cycle for a repeated branch")
+	}
+	if !HasCycle(newCycle()) {
+		t.Fatal("expected a cycle")
+	}
+	if !HasCycle(errors.Join(base, newCycle())) {
+		t.Fatal("expected a cycle in a joined branch")
+	}
+	// A cycle after a long chain, and a cycle through a joined error
+	tail := &cycleErr{name: "tail"}
+	var long error = tail
+	for i := 0; i < 1000; i++ {
+		long = &cycleErr{name: fmt.Sprint(i), next: long}
+	}
+	tail.next = long.(*cycleErr).next
+	if !HasCycle(long) {
+		t.Fatal("expected a cycle at the end of the chain")
+	}
+	join := &joinErr{}
+	join.errs = []error{base, fmt.Errorf("retry: %w", join)}
+	if !HasCycle(join) {
+		t.Fatal("expected a cycle through the joined error")
+	}
+}
+
+// A joined error whose branches can be set after creating it
+type joinErr struct {
+	errs []error
+}
+
+func (e *joinErr) Error() string {
+	return "join"
+}
+
+func (e *joinErr) Unwrap() []error {
+	return e.errs
+}
+
+func TestTraversalTerminatesOnCycle(t *testing.T) {
+	cycle := newCycle()
+	if depth := ChainDepth(cycle); depth != 2 {
+		t.Fatalf("expected a depth of 2, got %d", depth)
+	}
+	if n := len(AllErrors(cycle)); n != 2 {
+		t.Fatalf("expected 2 errors, got %d", n)
+	}
+	if rootCause(cycle) == nil {
+		t.Fatal("expected a root cause")
+	}
+	if HasStack(cycle) {
+		t.Fatal("expected no stack")
+	}
+	if _, ok := SeverityOf(cycle); ok {
+		t.Fatal("expected no severity")
+	}
+	if RootStacks(cycle) != nil {
+		t.Fatal("expected no root stacks")
+	}
+	if !HasStack(Wrap(cycle)) {
+		t.Fatal("expected a stack")
+	}
+}
+
+func TestTraversalOfUncomparableErrors(t *testing.T) {
+	outer := valErr{[]string{"y"}, valErr{[]string{"x"}, nil}}
+	if HasCycle(outer) {
+		t.Fatal("expected no cycle")
+	}
+	if HasStack(outer) {
+		t.Fatal("expected no stack")
+	}
+	if depth := ChainDepth(outer); depth != 2 {
+		t.Fatalf("expected a depth of 2, got %d", depth)
+	}
+	if n := len(AllErrors(errors.Join(outer, outer))); n != 5 {
+		t.Fatalf("expected 5 errors, got %d", n)
+	}
+}
+
+func TestRootStacks(t *testing.T) {
+	if RootStacks(errors.New("permission denied")) != nil {
+		t.Fatal("expected no root stacks")
+	}
+
+	// The innermost stackerr.Error keeps its own stacks below another error
+	inner := wrapInHelper(errors.New("permission denied"))
+	outer := WrapKeepingAllStacks(fmt.Errorf("outer: %w", inner))
+	root := RootStacks(outer)
+	if len(root) != 1 || !reflect.DeepEqual(root, inner.Stacks()) {
+		t.Fatalf("expected the inner stacks, got %v", root)
+	}
+	if len(outer.Stacks()) != 2 {
+		t.Fatalf("expected the outer error to have 2 stacks, got %d", len(outer.Stacks()))
+	}
+
+	// Wrapping a stackerr.Error directly merges the stacks into a single layer
+	merged := WrapKeepingAllStacks(inner)
+	if root := RootStacks(merged); len(root) != 2 || !reflect.DeepEqual(root, merged.Stacks()) {
+		t.Fatalf("expected the merged stacks, got %v", root)
+	}
+}
+
+func TestChainDepth(t *testing.T) {
+	if depth := ChainDepth(nil); depth != 0 {
+		t.Fatalf("expected a depth of 0, got %d", depth)
+	}
+	base := errors.New("lock timeout")
+	if depth := ChainDepth(base); depth != 1 {
+		t.Fatalf("expected a depth of 1, got %d", depth)
+	}
+	chain := fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", base))
+	if depth := ChainDepth(chain); depth != 3 {
+		t.Fatalf("expected a depth of 3, got %d", depth)
+	}
+	// The longest branch of a joined error is counted
+	if depth := ChainDepth(errors.Join(base, chain)); depth != 4 {
+		t.Fatalf("expected a depth of 4, got %d", depth)
+	}
+}
+
+func TestHasStack(t *testing.T) {
+	base := errors.New("invalid input")
+	if HasStack(nil) || HasStack(base) || HasStack(fmt.Errorf("outer: %w", base)) {
+		t.Fatal("expected no stack")
+	}
+	if !HasStack(Wrap(base)) || !HasStack(fmt.Errorf("outer: %w", Wrap(base))) {
+		t.Fatal("expected a stack")
+	}
+	// A stack is added when there isn't one yet
+	if !HasStack(WrapWithoutExtraStack(base)) {
+		t.Fatal("expected a stack")
+	}
+}
+
+func TestAllErrors(t *testing.T) {
+	if n := len(AllErrors(nil)); n != 0 {
+		t.Fatalf("expected no errors, got %d", n)
+	}
+	first, second := errors.New("first"), errors.New("second")
+	wrappedFirst := fmt.Errorf("context: %w", first)
+	wrappedSecond := Wrap(second)
+	joined := errors.Join(wrappedFirst, wrappedSecond)
+	tree := fmt.Errorf("outer: %w", joined)
+
+	// Errors are in the same depth-first order that errors.Is traverses them
+	all := AllErrors(tree)
+	expected := []error{tree, joined, wrappedFirst, first, wrappedSecond, second}
+	if len(all) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), all)
+	}
+	for i := range expected {
+		if all[i] != expected[i] {
+			t.Fatalf("expected error %d to be %v, got %v", i, expected[i], all[i])
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// The types that field values can be coerced to, by kind
+var coercionTypes = map[reflect.Kind]reflect.Type{
+	reflect.Bool:    reflect.TypeOf(false),
+	reflect.Int:     reflect.TypeOf(int(0)),
+	reflect.Int8:    reflect.TypeOf(int8(0)),
+	reflect.Int16:   reflect.TypeOf(int16(0)),
+	reflect.Int32:   reflect.TypeOf(int32(0)),
+	reflect.Int64:   reflect.TypeOf(int64(0)),
+	reflect.Uint:    reflect.TypeOf(uint(0)),
+	reflect.Uint8:   reflect.TypeOf(uint8(0)),
+	reflect.Uint16:  reflect.TypeOf(uint16(0)),
+	reflect.Uint32:  reflect.TypeOf(uint32(0)),
+	reflect.Uint64:  reflect.TypeOf(uint64(0)),
+	reflect.Float32: reflect.TypeOf(float32(0)),
+	reflect.Float64: reflect.TypeOf(float64(0)),
+	reflect.String:  reflect.TypeOf(""),
+}
+
+// coerceValue converts a value (e.g. as decoded from JSON) to a value of the given kind.
+func coerceValue(value any, kind reflect.Kind) (any, error) {
+	t, ok := coercionTypes[kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %s", kind)
+	}
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return nil, fmt.Errorf("cannot convert nil to %s", kind)
+	}
+	if v.Type() == t {
+		return value, nil
+	}
+	// Strings (e.g. from JSON-encoded 64-bit integers) are parsed first
+	if v.Kind() == reflect.String && kind != reflect.String {
+		var parsed any
+		var err error
+		// Integers are parsed as integers, so that 64-bit values don't lose precision
+		switch zero := reflect.Zero(t); {
+		case kind == reflect.Bool:
+			parsed, err = strconv.ParseBool(v.String())
+		case zero.CanInt():
+			parsed, err = strconv.ParseInt(v.String(), 10, 64)
+		case zero.CanUint():
+			parsed, err = strconv.ParseUint(v.String(), 10, 64)
+		default:
+			parsed, err = strconv.ParseFloat(v.String(), 64)
+		}
+		if err != nil {
+			return nil, err
+		}
+		v = reflect.ValueOf(parsed)
+	}
+
+	switch {
+	case kind == reflect.String:
+		if v.Kind() == reflect.String {
+			return v.Convert(t).Interface(), nil
+		}
+		return fmt.Sprint(value), nil
+	case kind == reflect.Bool:
+		if v.Kind() == reflect.Bool {
+			return v.Convert(t).Interface(), nil
+		}
+	case v.CanFloat():
+		f := v.Float()
+		zero := reflect.Zero(t)
+		switch {
+		case zero.CanInt():
+			if f != math.Trunc(f) || zero.OverflowInt(int64(f)) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return nil, fmt.Errorf("cannot convert %v to %s", value, kind)
+			}
+			return reflect.ValueOf(int64(f)).Convert(t).Interface(), nil
+		case zero.CanUint():
+			if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || zero.OverflowUint(uint64(f)) {
+				return nil, fmt.Errorf("cannot convert %v to %s", value, kind)
+			}
+			return reflect.ValueOf(uint64(f)).Convert(t).Interface(), nil
+		case zero.CanFloat():
+			if zero.OverflowFloat(f) {
+				return nil, fmt.Errorf("cannot convert %v to %s", value, kind)
+			}
+			return v.Convert(t).Interface(), nil
+		}
+	case v.CanInt():
+		i := v.Int()
+		zero := reflect.Zero(t)
+		switch {
+		case zero.CanInt():
+			if zero.OverflowInt(i) {
+				return nil, fmt.Errorf("cannot convert %v to %s", value, kind)
+			}
+			return v.Convert(t).Interface(), nil
+		case zero.CanUint():
+			if i < 0 || zero.OverflowUint(uint64(i)) {
+				return nil, fmt.Errorf("cannot convert %v to %s", value, kind)
+			}
+			return v.Convert(t).Interface(), nil
+		case zero.CanFloat():
+			return v.Convert(t).Interface(), nil
+		}
+	case v.CanUint():
+		u := v.Uint()
+		zero := reflect.Zero(t)
+		switch {
+		case zero.CanInt():
+			if u > math.MaxInt64 || zero.OverflowInt(int64(u)) {
+				return nil, fmt.Errorf("cannot convert %v to %s", value, kind)
+			}
+			return v.Convert(t).Interface(), nil
+		case zero.CanUint():
+			if zero.OverflowUint(u) {
+				return nil, fmt.Errorf("cannot convert %v to %s", value, kind)
+			}
+			return v.Convert(t).Interface(), nil
+		case zero.CanFloat():
+			return v.Convert(t).Interface(), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %T to %s", value, kind)
+}
+
+func (se *stackError) CoerceFields(schema map[string]reflect.Kind) error {
+	if !se.editable() {
+		return nil
+	}
+	// Sort the keys, so that any errors are in a consistent order
+	keys := make([]string, 0, len(schema))
+	for key := range schema {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var errs []error
+	for _, key := range keys {
+		kind := schema[key]
+		value, ok := se.MetaFields[key]
+		if !ok {
+			continue
+		}
+		coerced, err := coerceValue(value, kind)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("field %q: %w", key, err))
+			continue
+		}
+		se.MetaFields[key] = coerced
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,98 @@
+package stackerr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCoerceFields(t *testing.T) {
+	original := Wrap(errors.New("disk full")).With(map[string]any{
+		"attempts": 3,
+		"retry":    true,
+		"user":     "alice",
+	})
+	b, err := original.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshaled := &stackError{}
+	if err := json.Unmarshal(b, unmarshaled); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := unmarshaled.Fields()["attempts"].(float64); !ok {
+		t.Fatalf("expected the JSON number to be decoded as a float64, got %T", unmarshaled.Fields()["attempts"])
+	}
+
+	err = unmarshaled.CoerceFields(map[string]reflect.Kind{
+		"attempts": reflect.Int,
+		"retry":    reflect.Bool,
+		"missing":  reflect.Int,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := unmarshaled.Fields(); !reflect.DeepEqual(fields, original.Fields()) {
+		t.Fatalf("expected the Go types to be restored, got %#v", fields)
+	}
+}
+
+func TestCoerceFieldsInvalid(t *testing.T) {
+	err := Wrap(errors.New("upstream unavailable")).With(map[string]any{
+		"attempts": 2.5,
+		"count":    "many",
+		"retry":    true,
+	}).(*stackError)
+	cerr := err.CoerceFields(map[string]reflect.Kind{
+		"attempts": reflect.Int,
+		"count":    reflect.Uint,
+		"retry":    reflect.String,
+	})
+	if cerr == nil {
+		t.Fatal("expected the fields that can't be converted to be reported")
+	}
+	fields := err.Fields()
+	if fields["attempts"] != 2.5 || fields["count"] != "many" || fields["retry"] != "true" {
+		t.Fatalf("expected only the convertible field to be changed, got %#v", fields)
+	}
+}
+
+func TestCoerceFieldsIntegers(t *testing.T) {
+	err := Wrap(errors.New("quota exceeded")).With(map[string]any{
+		"id":       "9007199254740993",
+		"bytes":    "18446744073709551615",
+		"negative": "-1",
+		"small":    int64(300),
+		"large":    uint64(math.MaxUint64),
+		"signed":   int64(-5),
+		"retries":  uint16(7),
+	}).(*stackError)
+	cerr := err.CoerceFields(map[string]reflect.Kind{
+		"id":       reflect.Int64,
+		"bytes":    reflect.Uint64,
+		"negative": reflect.Uint,
+		"small":    reflect.Int8,
+		"large":    reflect.Int64,
+		"signed":   reflect.Uint32,
+		"retries":  reflect.Int8,
+	})
+	if cerr == nil {
+		t.Fatal("expected the out-of-range fields to be reported")
+	}
+	for _, key := range []string{"negative", "small", "large", "signed"} {
+		if !strings.Contains(cerr.Error(), fmt.Sprintf("field %q", key)) {
+			t.Fatalf("expected field %q to be reported, got %q", key, cerr)
+		}
+	}
+	fields := err.Fields()
+	if fields["id"] != int64(9007199254740993) || fields["bytes"] != uint64(math.MaxUint64) || fields["retries"] != int8(7) {
+		t.Fatalf("expected the integers to be converted exactly, got %#v", fields)
+	}
+	if fields["small"] != int64(300) || fields["signed"] != int64(-5) {
+		t.Fatalf("expected the out-of-range fields to be unchanged, got %#v", fields)
+	}
+}
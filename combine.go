@@ -0,0 +1,168 @@
+package stackerr
+
+import (
+	"errors"
+)
+
+// Join joins multiple errors into a single stackerr.Error, using the stack trace
+// at the point where this function was called. Nil errors are discarded, and if
+// all errors are nil, nil is returned. The joined errors can be found with
+// errors.Is and errors.As, and each one keeps its own stacks.
+func Join(errs ...error) Error {
+	return new(errors.Join(errs...), 1, true)
+}
+
+// WrapMulti joins multiple errors into a single stackerr.Error with the given
+// fields, using the stack trace at the point where this function was called.
+// Nil errors are discarded, and if all errors are nil, nil is returned. If there
+// is only one non-nil error, it's wrapped directly instead of being joined.
+func WrapMulti(fields map[string]any, errs ...error) Error {
+	nonNil := make([]error, 0, len(errs))
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+		}
+	}
+	var err error
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		err = nonNil[0]
+	default:
+		err = errors.Join(nonNil...)
+	}
+	se := wrapError(err, 1, true, collapseParentStacks.Load())
+	se.WithInPlace(fields)
+	runWrapHooks(se)
+	return se
+}
+
+// rootCause gets the innermost error in an error's chain.
+func rootCause(err error) error {
+	root := err
+	walkChain(err, func(err error) bool {
+		root = err
+		return true
+	})
+	return root
+}
+
+// Combine combines two errors that wrap the same root cause (e.g. the same error
+// that propagated along two paths) into a single stackerr.Error. The combined error
+// has the message of `a`, the stacks of both errors, and the fields of both errors
+// (with the fields of `a` taking priority). If the errors have different root
+// causes, they are joined with Join instead.
+func Combine(a, b error) Error {
+	if a == nil {
+		return new(b, 1, false)
+	}
+	if b == nil {
+		return new(a, 1, false)
+	}
+	if !errors.Is(rootCause(a), rootCause(b)) {
+		return new(errors.Join(a, b), 1, true)
+	}
+
+	sa := wrapError(a, 1, false, collapseParentStacks.Load())
+	sb := wrapError(b, 1, false, collapseParentStacks.Load())
+	combined := sa.clone()
+	// Remove duplicates first, since RemoveParents treats
+	// duplicate stacks as parents of each other
+	combined.StackTraces, combined.StackMetas = distinctStacks(concatStacks(sa.StackTraces, sa.StackMetas, sb.StackTraces, sb.StackMetas))
+	if collapseParentStacks.Load() {
+		before := len(combined.StackTraces)
+		combined.StackTraces, combined.StackMetas = removeParentStacks(combined.StackTraces, combined.StackMetas)
+		combined.CollapsedStacks += before - len(combined.StackTraces)
+	}
+	for k, v := range sb.MetaFields {
+		if _, ok := combined.MetaFields[k]; !ok {
+			combined.MetaFields[k] = v
+		}
+	}
+	if combined.Level == severityUnset {
+		combined.Level = sb.Level
+	}
+	if len(sb.PrivateKeys) > 0 {
+		privateKeys := make(map[string]struct{}, len(combined.PrivateKeys)+len(sb.PrivateKeys))
+		for k := range combined.PrivateKeys {
+			privateKeys[k] = struct{}{}
+		}
+		for k := range sb.PrivateKeys {
+			privateKeys[k] = struct{}{}
+		}
+		combined.PrivateKeys = privateKeys
+	}
+	runWrapHooks(combined)
+	return combined
+}
+
+// stacksOf gets the stacks of the first stackerr.Error in an error's chain.
+func stacksOf(err error) Stacks {
+	var serr *stackError
+	if errors.As(err, &serr) {
+		return serr.resolvedStacks()
+	}
+	return nil
+}
+
+// RootStacks gets the stacks of the innermost stackerr.Error in an error's chain.
+// It returns nil if there is no stackerr.Error in the chain. Note that wrapping a
+// stackerr.Error directly (e.g. Wrap(Wrap(err))) doesn't add a layer to the chain,
+// since the stacks are merged into a single stackerr.Error, so the innermost one
+// only has its own stacks if it's below another error (e.g. from fmt.Errorf).
+func RootStacks(err error) Stacks {
+	var root *stackError
+	walkChain(err, func(err error) bool {
+		if serr, ok := err.(*stackError); ok {
+			root = serr
+		}
+		return true
+	})
+	if root == nil {
+		return nil
+	}
+	return root.resolvedStacks()
+}
+
+// HasStack checks whether an error carries at least one stack, i.e. whether
+// any stackerr.Error (or "github.com/pkg/errors" stack error, unless
+// SetImportPkgErrorsStacks is disabled) in its chain has a stack. This can be
+// used to find sources of errors that were created without one.
+func HasStack(err error) bool {
+	hasStack := false
+	walkChain(err, func(err error) bool {
+		if serr, ok := err.(*stackError); ok && len(serr.StackTraces) > 0 {
+			hasStack = true
+		} else if _, ok := err.(stackTracer); ok && importPkgErrorsStacks.Load() {
+			hasStack = true
+		}
+		return !hasStack
+	})
+	return hasStack
+}
+
+// Contains checks whether the `inner` error is effectively contained in the `outer`
+// error, i.e. they have the same root cause and every stack of `inner` is also
+// in `outer`, either directly or as the parent of one of its stacks (see
+// Stack.IsParentOf). For example, this is true if `outer` was created by
+// wrapping `inner`.
+func Contains(outer, inner error) bool {
+	if outer == nil || inner == nil || !errors.Is(rootCause(outer), rootCause(inner)) {
+		return false
+	}
+	outerStacks := stacksOf(outer)
+	for _, innerStack := range stacksOf(inner) {
+		found := false
+		for _, outerStack := range outerStacks {
+			if innerStack.IsParentOf(outerStack) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
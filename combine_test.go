@@ -0,0 +1,118 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// wrapInOtherHelper wraps an error in a different function than wrapInHelper
+func wrapInOtherHelper(err error) Error {
+	return Wrap(err)
+}
+
+func TestCombineSameRoot(t *testing.T) {
+	root := errors.New("root")
+	a := wrapInHelper(root).With(map[string]any{"path": "a", "from_a": true})
+	b := wrapInOtherHelper(root).With(map[string]any{"path": "b", "from_b": true})
+
+	combined := Combine(a, b)
+	if combined.Error() != a.Error() || !errors.Is(combined, root) {
+		t.Fatalf("unexpected combined error %q", combined.Error())
+	}
+	if stacks := combined.Stacks(); !stacks.Equal(Stacks{a.Stacks()[0], b.Stacks()[0]}) {
+		t.Fatalf("expected the stacks of both errors, got %v", stacks)
+	}
+	fields := combined.Fields()
+	if fields["path"] != "a" || fields["from_a"] != true || fields["from_b"] != true {
+		t.Fatalf("expected the merged fields with a's keys winning, got %v", fields)
+	}
+
+	// The same stack isn't repeated
+	if n := len(Combine(a, a).Stacks()); n != 1 {
+		t.Fatalf("expected 1 stack when combining an error with itself, got %d", n)
+	}
+	if Combine(nil, nil) != nil || Combine(a, nil).Error() != a.Error() || Combine(nil, b).Error() != b.Error() {
+		t.Fatal("expected nil errors to be ignored")
+	}
+}
+
+func TestCombineDifferentRoots(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+	combined := Combine(Wrap(first), Wrap(second))
+	if !errors.Is(combined, first) || !errors.Is(combined, second) {
+		t.Fatal("expected both errors to be in the chain")
+	}
+	if combined.Error() != "first\nsecond" {
+		t.Fatalf("expected the errors to be joined, got %q", combined.Error())
+	}
+}
+
+func TestJoin(t *testing.T) {
+	if Join(nil, nil) != nil {
+		t.Fatal("expected nil when all errors are nil")
+	}
+	first, second := Wrap(errors.New("first")), errors.New("second")
+	joined := Join(first, nil, second)
+	if !errors.Is(joined, first) || !errors.Is(joined, second) || joined.Error() != "first\nsecond" {
+		t.Fatalf("unexpected joined error %q", joined.Error())
+	}
+	if top, _ := joined.Stacks()[0].Top(); top.Function != packageFunctionPrefix+"TestJoin" {
+		t.Fatalf("expected a stack from the caller, got %v", top)
+	}
+	// Each joined error keeps its own stacks
+	var inner Error
+	if !errors.As(joined.Unwrap(), &inner) || !inner.Stacks().Equal(first.Stacks()) {
+		t.Fatal("expected the joined error to keep its stacks")
+	}
+}
+
+func TestContains(t *testing.T) {
+	root := errors.New("root")
+	inner := wrapInHelper(root)
+	outer := Wrap(fmt.Errorf("outer: %w", Wrap(inner)))
+	if !Contains(outer, inner) {
+		t.Fatal("expected a re-wrapped error to contain the inner error")
+	}
+
+	// Only one of the two stacks is in the outer error
+	both := Combine(inner, wrapInOtherHelper(root))
+	if len(both.Stacks()) != 2 {
+		t.Fatalf("expected 2 stacks, got %d", len(both.Stacks()))
+	}
+	if Contains(outer, both) {
+		t.Fatal("expected a partial overlap not to be contained")
+	}
+	if !Contains(both, inner) {
+		t.Fatal("expected the combined error to contain the inner error")
+	}
+
+	if Contains(Wrap(errors.New("other")), inner) || Contains(nil, inner) || Contains(outer, nil) {
+		t.Fatal("expected unrelated errors not to be contained")
+	}
+}
+
+func TestWrapMulti(t *testing.T) {
+	fields := map[string]any{"op": "cleanup"}
+	if WrapMulti(fields, nil, nil) != nil {
+		t.Fatal("expected nil when all errors are nil")
+	}
+
+	primary := errors.New("primary")
+	single := WrapMulti(fields, nil, primary)
+	if !errors.Is(single, primary) || single.Error() != "primary" || single.Fields()["op"] != "cleanup" {
+		t.Fatalf("unexpected error %q with fields %v", single.Error(), single.Fields())
+	}
+
+	cleanup := errors.New("cleanup")
+	multi := WrapMulti(fields, primary, cleanup)
+	if !errors.Is(multi, primary) || !errors.Is(multi, cleanup) {
+		t.Fatal("expected both errors to be in the chain")
+	}
+	if multi.Fields()["op"] != "cleanup" {
+		t.Fatalf("expected the shared fields, got %v", multi.Fields())
+	}
+	if top, _ := multi.Stacks()[0].Top(); top.Function != packageFunctionPrefix+"TestWrapMulti" {
+		t.Fatalf("expected a stack from the caller, got %v", top)
+	}
+}
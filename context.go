@@ -0,0 +1,45 @@
+package stackerr
+
+import (
+	"context"
+	"errors"
+)
+
+// IsCanceled checks whether the error is (or wraps) context.Canceled. Since a
+// stackerr.Error unwraps to the error it wraps (and wrapping a stackerr.Error
+// keeps the original wrapped error), all layers of the chain are checked.
+func IsCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+// IsDeadlineExceeded is the same as IsCanceled, but for context.DeadlineExceeded.
+func IsDeadlineExceeded(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// TimeoutField is the reserved field that WrapTimeout sets to true for
+// an error that is (or wraps) context.DeadlineExceeded.
+const TimeoutField string = "timeout"
+
+// TimeoutOperationField is the reserved field that WrapTimeout uses to store
+// the operation that timed out.
+const TimeoutOperationField string = "timeout_operation"
+
+// WrapTimeout wraps an error into a stackerr.Error, using the stack trace at the
+// point where this function was called. If the error is (or wraps)
+// context.DeadlineExceeded, the TimeoutField field is set to true and the
+// TimeoutOperationField field is set to `operation`.
+func WrapTimeout(err error, operation string) Error {
+	se := wrapError(err, 1, true, collapseParentStacks.Load())
+	if se == nil {
+		return nil
+	}
+	if IsDeadlineExceeded(err) {
+		se.WithInPlace(map[string]any{
+			TimeoutField:          true,
+			TimeoutOperationField: operation,
+		})
+	}
+	runWrapHooks(se)
+	return se
+}
@@ -0,0 +1,48 @@
+package stackerr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIsCanceledAndIsDeadlineExceeded(t *testing.T) {
+	canceled := Wrap(fmt.Errorf("query: %w", Wrap(Wrap(context.Canceled)).WithSingle("k", "v")))
+	canceled = Wrapf(canceled, "handler")
+	if !IsCanceled(canceled) || IsDeadlineExceeded(canceled) {
+		t.Fatal("expected a canceled error")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	timedOut := Wrap(errors.Join(errors.New("other"), fmt.Errorf("query: %w", Wrap(ctx.Err()))))
+	if !IsDeadlineExceeded(timedOut) || IsCanceled(timedOut) {
+		t.Fatal("expected a timed out error")
+	}
+
+	if IsCanceled(nil) || IsDeadlineExceeded(Wrap(errors.New("token expired"))) {
+		t.Fatal("expected other errors not to match")
+	}
+}
+
+func TestWrapTimeout(t *testing.T) {
+	if WrapTimeout(nil, "query") != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	err := WrapTimeout(fmt.Errorf("query: %w", ctx.Err()), "load user")
+	if err.Fields()[TimeoutField] != true || err.Fields()[TimeoutOperationField] != "load user" {
+		t.Fatalf("expected the timeout fields, got %v", err.Fields())
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected the deadline to be exceeded")
+	}
+	if other := WrapTimeout(context.Canceled, "load user"); len(other.Fields()) != 0 {
+		t.Fatalf("expected no timeout fields, got %v", other.Fields())
+	}
+}
@@ -0,0 +1,45 @@
+package stackerr
+
+import (
+	"errors"
+	"reflect"
+)
+
+// fieldsOf gets the fields of the first stackerr.Error in an error's chain.
+func fieldsOf(err error) map[string]any {
+	var serr *stackError
+	if errors.As(err, &serr) {
+		return serr.MetaFields
+	}
+	return nil
+}
+
+// Diff reports what changed between two states of an error, e.g. before and
+// after it was decorated or re-wrapped. It returns the fields that are in `after`
+// but not in `before` (or that have a different value), and the stacks that are
+// in `after` but not in `before`. It's intended as a debugging aid.
+func Diff(before, after error) (addedFields map[string]any, addedStacks Stacks) {
+	addedFields = map[string]any{}
+	beforeFields := fieldsOf(before)
+	for k, v := range fieldsOf(after) {
+		if bv, ok := beforeFields[k]; !ok || !reflect.DeepEqual(bv, v) {
+			addedFields[k] = v
+		}
+	}
+
+	addedStacks = Stacks{}
+	beforeStacks := chainStacks(before)
+	for _, stack := range chainStacks(after) {
+		found := false
+		for _, beforeStack := range beforeStacks {
+			if stack.Equal(beforeStack) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			addedStacks = append(addedStacks, stack)
+		}
+	}
+	return addedFields, addedStacks
+}
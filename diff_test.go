@@ -0,0 +1,36 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDiffFields(t *testing.T) {
+	before := Wrap(errors.New("bad gateway")).WithSingle("user", "alice")
+	after := before.With(map[string]any{"user": "bob", "request": 7})
+	fields, stacks := Diff(before, after)
+	if len(fields) != 2 || fields["user"] != "bob" || fields["request"] != 7 {
+		t.Fatalf("expected the added and changed fields, got %v", fields)
+	}
+	if len(stacks) != 0 {
+		t.Fatalf("expected no added stacks, got %v", stacks)
+	}
+}
+
+func TestDiffStacks(t *testing.T) {
+	before := wrapInHelper(errors.New("no such host"))
+	after := WrapKeepingAllStacks(fmt.Errorf("outer: %w", before))
+	fields, stacks := Diff(before, after)
+	if len(fields) != 0 {
+		t.Fatalf("expected no added fields, got %v", fields)
+	}
+	if len(stacks) != 1 || !stacks[0].Equal(after.Stacks()[0]) {
+		t.Fatalf("expected the re-wrap's stack, got %v", stacks)
+	}
+
+	// Errors without stackerr layers have nothing to diff
+	if fields, stacks := Diff(errors.New("a"), errors.New("b")); len(fields) != 0 || len(stacks) != 0 {
+		t.Fatalf("expected no differences, got %v and %v", fields, stacks)
+	}
+}
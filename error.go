@@ -4,6 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	nativeStackErrors "github.com/pkg/errors"
 )
@@ -20,22 +29,136 @@ type Error interface {
 	// Stacks returns all stacks associated with this stackerr.Error,
 	// ordered from most recent to oldest.
 	Stacks() Stacks
+	// StackCapturedAt returns the time at which each stack was captured, in the
+	// same order as Stacks. A stack that was captured while SetCaptureStackTimestamps
+	// was disabled (or that was given explicitly, e.g. with WrapWithStack) has the zero time.
+	StackCapturedAt() []time.Time
+	// StackLabels returns the label of each stack, as set with WrapLabeled, in
+	// the same order as Stacks. A stack without a label has an empty label.
+	StackLabels() []string
 	// FormatStack returns the stackerr.Error's stacks in a human-readable form.
 	FormatStacks() string
+	// FormatStacksNormalized is the same as FormatStacks, except that the
+	// stacks are normalized for stable comparisons with the given options
+	// (see Stacks.Normalize).
+	FormatStacksNormalized(opts ...NormalizeOption) string
+	// FormatStacksDedup is the same as FormatStacks, except that any identical
+	// stacks (see Stacks.Distinct) are only included once.
+	FormatStacksDedup() string
 	// FormatStackJson returns the stackerr.Error's stacks in JSON form.
 	FormatStacksJson() string
-	// Unwrap returns the error that this stackerr.Error is wrapping.
+	// Unwrap returns the error that this stackerr.Error is wrapping. Wrapping a
+	// stackerr.Error directly doesn't nest it, so this is never a stackerr.Error
+	// unless another error (e.g. from fmt.Errorf's %w) is between them. See
+	// AllErrors to enumerate the whole tree of wrapped errors.
 	Unwrap() error
+	// Is reports whether the wrapped error matches `target`, either by being
+	// equal to it or by its own Is method. It doesn't follow the rest of the
+	// chain, since errors.Is already calls it for each error in the chain.
+	Is(target error) bool
+	// As sets `target` to the wrapped error if it's assignable to it, or calls
+	// the wrapped error's own As method. Like Is, it doesn't follow the rest
+	// of the chain; use errors.As for that.
+	As(target any) bool
 	// Fields returns a map of key-value pairs that are associated with
-	// this stackerr.Error.
+	// this stackerr.Error. The map is read-only: use With, WithSingle or
+	// WithInPlace to add fields. For an error without fields, it's a new
+	// empty map, since the error's map isn't allocated until it has fields.
 	Fields() map[string]any
 	// With adds one or more key-value pairs to this stackerr.Error, overwriting
 	// any existing key-value pair with the same key.
 	With(keyValuePairs map[string]any) Error
+	// SortedFields returns a copy of the key-value pairs that are associated
+	// with this stackerr.Error, sorted by key.
+	SortedFields() []Field
 	// WithSingle adds a single key-value pair to this stackerr.Error, overwriting
 	// any existing key-value pair with the same key. It is equivalent to calling
 	// With with a single key/value in the map.
 	WithSingle(key string, value any) Error
+	// WithAppendField returns a copy of this stackerr.Error where `value` is appended
+	// to the list of values (a []any) of the field with the given key, instead of
+	// overwriting it. Since wrapping keeps the fields of the wrapped error, this keeps
+	// the value from each layer that sets the field (e.g. "attempt"), oldest first.
+	// If the field has a value that isn't a list, it becomes the first value of the list.
+	WithAppendField(key string, value any) Error
+	// WithIf is like With, but only adds the key-value pairs if `cond`
+	// is true. Otherwise, it returns this stackerr.Error unchanged.
+	WithIf(cond bool, keyValuePairs map[string]any) Error
+	// ForkFields returns a copy of this stackerr.Error that shares the same
+	// stacks by reference, but has its own independent copy of the fields.
+	// This is cheaper than With/WithSingle when the stacks are large and
+	// fields will be added to the same base error many times.
+	ForkFields() Error
+	// CollapseSelfWraps returns a copy of this stackerr.Error where consecutive
+	// stacks that originate in the same function (e.g. from a recursive function
+	// wrapping the error at each level) are collapsed into a single stack, and
+	// runs of consecutive equal values in appended fields (see WithAppendField)
+	// are collapsed into a single value.
+	CollapseSelfWraps() Error
+	// ToECS returns this stackerr.Error in Elastic Common Schema form, with
+	// the "error.message", "error.type" and "error.stack_trace" keys, and
+	// each field flattened under the "labels." prefix.
+	ToECS() map[string]any
+	// TranslateTo returns a copy of this stackerr.Error that wraps `newErr`
+	// instead of the current wrapped error, keeping the stacks and fields.
+	// If `keepInChain` is true, the current wrapped error can still be
+	// found with errors.Is and errors.As.
+	TranslateTo(newErr error, keepInChain bool) Error
+	// PanicValue returns the raw value that was recovered from a panic, if this
+	// stackerr.Error was created by FromRecover or FromRecoverSkip. For an error
+	// that was unmarshaled from JSON, it's the string form of the value instead.
+	PanicValue() (any, bool)
+	// WithSeverity returns a copy of this stackerr.Error with the given severity
+	// level, overwriting any existing severity level. See SeverityOf.
+	WithSeverity(level Severity) Error
+	// Summary returns the error message on a single line, followed by where the
+	// newest stack originated, e.g. "connection refused (service.Connect at
+	// dial.go:42)". If there are no stacks, it's just the error message.
+	Summary() string
+	// SafeError returns the error message with all redactors registered
+	// with RegisterMessageRedactor applied to it.
+	SafeError() string
+	// InvolvedFunctions returns the names of all functions that appear in any of
+	// this stackerr.Error's stacks, without duplicates, in order of first appearance
+	// (newest stack first). Functions from the runtime package are excluded.
+	InvolvedFunctions() []string
+	// FormatFull returns the error message, followed by the fields (sorted
+	// by key, if there are any) and then the stacks, in a human-readable form.
+	FormatFull() string
+	// WithoutStacks returns a copy of this stackerr.Error that has no
+	// stacks, but keeps the message and fields.
+	WithoutStacks() Error
+	// WithFieldVisibility returns a copy of this stackerr.Error where the field
+	// with the given key is public (included in the JSON form, which is the
+	// default) or private (excluded from the JSON form, but still returned by Fields).
+	WithFieldVisibility(key string, public bool) Error
+	// CollapsedStackCount returns the number of stacks that were removed while
+	// wrapping this stackerr.Error, for being the parent of another stack (see
+	// Stacks.RemoveParents and SetCollapseParentStacks).
+	CollapsedStackCount() int
+	// WithAttachment returns a copy of this stackerr.Error with a named blob of
+	// data (e.g. a request snapshot) that travels with it, overwriting any existing
+	// attachment with the same name. Attachments aren't fields, and they're excluded
+	// from the formatted and JSON forms (see MarshalWithAttachments).
+	WithAttachment(name string, data []byte) Error
+	// Attachment returns the data of the attachment with the given name, as
+	// added with WithAttachment.
+	Attachment(name string) ([]byte, bool)
+	// MarshalWithAttachments is the same as MarshalJSON, except that the
+	// attachments are included, base64-encoded, in the "attachments" key.
+	MarshalWithAttachments() ([]byte, error)
+	// Freeze returns a copy of this stackerr.Error that can't be edited in place,
+	// e.g. before it crosses an API boundary. The InPlaceEditError methods of the
+	// copy do nothing (or panic, see SetPanicOnFrozenEdit), but methods that
+	// return a modified copy (e.g. With) still work, and their copies aren't frozen.
+	Freeze() Error
+	// WithRelated returns a copy of this stackerr.Error with an error that is
+	// related to it (e.g. an error that occurred during a rollback), but that
+	// isn't part of its chain, so it isn't found by errors.Is or errors.As.
+	WithRelated(related error) Error
+	// Related returns the errors that were attached with WithRelated, in the
+	// order they were attached.
+	Related() []error
 }
 
 // A special interface that can be used to add key-value pairs in-place, without
@@ -51,27 +174,345 @@ type InPlaceEditError interface {
 	// SetError will set the stacks for a stackerr.Error,
 	// without cloning the original stackerr.Error first.
 	SetStacks(stacks Stacks)
+	// CoerceFields converts the values of fields (e.g. after a JSON round
+	// trip, where numbers are decoded as float64) to the kinds in the schema,
+	// without cloning the original stackerr.Error first. Fields that aren't in
+	// the schema are unchanged. Only bool, numeric, and string kinds are
+	// supported, and an error is returned for any field that can't be converted.
+	CoerceFields(schema map[string]reflect.Kind) error
+}
+
+// Field is a key-value pair that is associated with a stackerr.Error.
+type Field struct {
+	Key   string
+	Value any
+}
+
+// translatedError is an error that has been translated into a new
+// error, but keeps the original error discoverable by errors.Is/As.
+type translatedError struct {
+	err      error
+	original error
+}
+
+func (te *translatedError) Error() string {
+	return te.err.Error()
+}
+
+func (te *translatedError) Unwrap() error {
+	return te.err
+}
+
+func (te *translatedError) Is(target error) bool {
+	return errors.Is(te.original, target)
+}
+
+func (te *translatedError) As(target any) bool {
+	return errors.As(te.original, target)
 }
 
 type stackError struct {
 	Err         error          `json:"err"`
 	StackTraces Stacks         `json:"stack_traces"`
 	MetaFields  map[string]any `json:"meta_fields"`
+	Level       Severity       `json:"severity"`
+	// The keys of fields that are excluded from the JSON form. The
+	// map is never modified once set, so it can be shared between errors.
+	PrivateKeys map[string]struct{} `json:"-"`
+	// Errors that are related to this one, but aren't in its chain (shared
+	// between errors, like PrivateKeys)
+	RelatedErrors []error `json:"-"`
+	// Whether the in-place edit methods are disabled (see Freeze)
+	Frozen bool `json:"-"`
+	// Opaque data that travels with the error, by name (shared between
+	// errors, like PrivateKeys)
+	Attachments map[string][]byte `json:"-"`
+	// The number of stacks that have been removed for being the parent of
+	// another stack (see Stacks.RemoveParents) while wrapping this error
+	CollapsedStacks int `json:"-"`
+	// The kinds of the error (see WithKind), by the type of the kind (shared
+	// between errors, like PrivateKeys)
+	Kinds map[reflect.Type]any `json:"-"`
+	// The metadata of the stacks, in the same order as the stacks (or nil if none
+	// of them have metadata). Like the stacks, it's never modified in place.
+	StackMetas stackMetas `json:"-"`
+	// The raw value that was recovered from a panic (see PanicValue). It's
+	// kept out of the fields, which only have its string form, since it
+	// can be any value, including one that can't be marshaled.
+	RecoveredValue any `json:"-"`
+}
+
+// newAtomicBool creates an atomic.Bool with an initial value, for settings that default to true.
+func newAtomicBool(v bool) *atomic.Bool {
+	b := &atomic.Bool{}
+	b.Store(v)
+	return b
+}
+
+// newAtomicPointer creates an atomic.Pointer with an initial value, for settings that have a default.
+func newAtomicPointer[T any](v *T) *atomic.Pointer[T] {
+	p := &atomic.Pointer[T]{}
+	p.Store(v)
+	return p
+}
+
+// Whether the human-readable stacks should be included when marshaling to JSON
+var includeStackText atomic.Bool
+
+// SetIncludeStackText sets whether the JSON form of a stackerr.Error should
+// include a "stack_text" field with the human-readable (FormatStacks) form of
+// its stacks. Defaults to false.
+func SetIncludeStackText(include bool) {
+	includeStackText.Store(include)
+}
+
+// The maximum size of a field value when marshaling to JSON (0 for no maximum)
+var maxFieldValueBytes atomic.Int64
+
+// The marker appended to field values that were truncated when marshaling
+const truncatedMarker string = "...(truncated)"
+
+// SetMaxFieldValueBytes sets the maximum size, in bytes, of each field value when
+// marshaling a stackerr.Error to JSON. String values longer than this, and other
+// values whose JSON form is longer than this, are truncated and marked with
+// "...(truncated)". The stored field values are not changed. A value of 0 (the
+// default) means there is no maximum.
+func SetMaxFieldValueBytes(n int) {
+	maxFieldValueBytes.Store(int64(n))
+}
+
+// The maximum size of the message returned by Error
+var maxMessageBytes atomic.Int64
+
+// SetMaxMessageBytes sets the maximum size, in bytes, of the message returned by the
+// Error method of a stackerr.Error. Longer messages are truncated and marked with
+// "...(truncated)". The wrapped error is not changed, so its full message is still
+// available with Unwrap().Error(). A value of 0 (the default) means there is no maximum.
+func SetMaxMessageBytes(n int) {
+	maxMessageBytes.Store(int64(n))
+}
+
+// truncateString truncates a string to at most `n` bytes (without
+// splitting a UTF-8 character) and appends the truncated marker.
+func truncateString(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + truncatedMarker
+}
+
+// truncateFields returns a copy of the fields with any values
+// that exceed the maximum field value size truncated.
+func truncateFields(fields map[string]any, n int) map[string]any {
+	truncated := make(map[string]any, len(fields))
+	for k, v := range fields {
+		if str, ok := v.(string); ok {
+			if len(str) > n {
+				v = truncateString(str, n)
+			}
+		} else if b, err := json.Marshal(v); err == nil && len(b) > n {
+			v = truncateString(string(b), n)
+		}
+		truncated[k] = v
+	}
+	return truncated
+}
+
+// SchemaVersion is the version of the JSON form of a stackerr.Error. It is
+// included in the marshaled JSON as "_v". When unmarshaling, payloads
+// without a version are treated as version 0, and payloads with a newer
+// version than this are rejected.
+const SchemaVersion int = 1
+
+// The JSON representation of a stackError. The wrapped
+// error is represented by its message.
+type jsonStackError struct {
+	Version     int            `json:"_v"`
+	Err         string         `json:"err"`
+	StackTraces Stacks         `json:"stack_traces"`
+	MetaFields  map[string]any `json:"meta_fields"`
+	StackText   string         `json:"stack_text,omitempty"`
+	Severity    string         `json:"severity,omitempty"`
+	// The capture times of the stacks, in the same order as the stacks.
+	// Only included if at least one stack has a capture time.
+	StackCapturedAt []time.Time `json:"stack_captured_at,omitempty"`
+	// The labels of the stacks, in the same order as the stacks.
+	// Only included if at least one stack has a label.
+	StackLabels []string      `json:"stack_labels,omitempty"`
+	Related     []*stackError `json:"related,omitempty"`
+	// Only included by MarshalWithAttachments
+	Attachments     map[string][]byte `json:"attachments,omitempty"`
+	CollapsedStacks int               `json:"collapsed_stacks,omitempty"`
 }
 
 func (se *stackError) MarshalJSON() ([]byte, error) {
-	return json.Marshal(se)
+	return se.marshalJSON(false)
+}
+
+func (se *stackError) MarshalWithAttachments() ([]byte, error) {
+	return se.marshalJSON(true)
+}
+
+func (se *stackError) marshalJSON(withAttachments bool) ([]byte, error) {
+	jse := jsonStackError{
+		Version:         SchemaVersion,
+		StackTraces:     se.resolvedStacks(),
+		MetaFields:      se.Fields(),
+		CollapsedStacks: se.CollapsedStacks,
+	}
+	if se.Err != nil {
+		jse.Err = se.Err.Error()
+	}
+	if len(se.PrivateKeys) > 0 {
+		publicFields := make(map[string]any, len(jse.MetaFields))
+		for k, v := range jse.MetaFields {
+			if _, ok := se.PrivateKeys[k]; !ok {
+				publicFields[k] = v
+			}
+		}
+		jse.MetaFields = publicFields
+	}
+	if maxBytes := int(maxFieldValueBytes.Load()); maxBytes > 0 {
+		jse.MetaFields = truncateFields(jse.MetaFields, maxBytes)
+	}
+	if includeStackText.Load() {
+		jse.StackText = se.FormatStacks()
+	}
+	jse.Severity = se.Level.String()
+	for i := range jse.StackTraces {
+		m := se.StackMetas.at(i)
+		if !m.CapturedAt.IsZero() {
+			if jse.StackCapturedAt == nil {
+				jse.StackCapturedAt = make([]time.Time, len(jse.StackTraces))
+			}
+			jse.StackCapturedAt[i] = m.CapturedAt
+		}
+		if m.Label != "" {
+			if jse.StackLabels == nil {
+				jse.StackLabels = make([]string, len(jse.StackTraces))
+			}
+			jse.StackLabels[i] = m.Label
+		}
+	}
+	for _, related := range se.RelatedErrors {
+		// Related errors that aren't stack errors are represented by their message
+		rse, ok := related.(*stackError)
+		if !ok {
+			rse = &stackError{
+				Err: related,
+			}
+		}
+		jse.Related = append(jse.Related, rse)
+	}
+	if withAttachments {
+		jse.Attachments = se.Attachments
+	}
+	return json.Marshal(jse)
+}
+
+// The JSON representation of a stackError before the schema was versioned
+// (version 0), where the wrapped error was marshaled as-is, so it isn't
+// necessarily a string.
+type jsonStackErrorV0 struct {
+	Err         json.RawMessage `json:"err"`
+	StackTraces Stacks          `json:"stack_traces"`
+	MetaFields  map[string]any  `json:"meta_fields"`
 }
 
 func (se *stackError) UnmarshalJSON(data []byte) error {
-	return json.Unmarshal(data, se)
+	versions := struct {
+		Version int `json:"_v"`
+	}{}
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return err
+	}
+	version := versions.Version
+	switch {
+	case version > SchemaVersion:
+		return fmt.Errorf("stackerr: unsupported schema version %d (newest supported version is %d)", version, SchemaVersion)
+	case version == 0:
+		return se.unmarshalJSONV0(data)
+	}
+
+	jse := jsonStackError{}
+	if err := json.Unmarshal(data, &jse); err != nil {
+		return err
+	}
+	se.Err = errors.New(jse.Err)
+	se.StackTraces = jse.StackTraces
+	se.Level, _ = parseSeverity(jse.Severity)
+	se.StackMetas = nil
+	for i := range se.StackTraces {
+		m := stackMeta{}
+		if i < len(jse.StackCapturedAt) {
+			m.CapturedAt = jse.StackCapturedAt[i]
+		}
+		if i < len(jse.StackLabels) {
+			m.Label = jse.StackLabels[i]
+		}
+		se.StackMetas = se.StackMetas.set(len(se.StackTraces), i, m)
+	}
+	se.MetaFields = jse.MetaFields
+	if se.MetaFields == nil {
+		se.MetaFields = map[string]any{}
+	}
+	se.RelatedErrors = nil
+	for _, related := range jse.Related {
+		se.RelatedErrors = append(se.RelatedErrors, related)
+	}
+	se.Attachments = jse.Attachments
+	se.CollapsedStacks = jse.CollapsedStacks
+	return nil
+}
+
+// unmarshalJSONV0 unmarshals a payload that has no schema version. The message
+// is only kept if the wrapped error was marshaled as a string.
+func (se *stackError) unmarshalJSONV0(data []byte) error {
+	jse := jsonStackErrorV0{}
+	if err := json.Unmarshal(data, &jse); err != nil {
+		return err
+	}
+	var message string
+	if err := json.Unmarshal(jse.Err, &message); err != nil {
+		message = ""
+	}
+	se.Err = errors.New(message)
+	se.StackTraces = jse.StackTraces
+	se.StackMetas = nil
+	se.Level = severityUnset
+	se.MetaFields = jse.MetaFields
+	if se.MetaFields == nil {
+		se.MetaFields = map[string]any{}
+	}
+	se.RelatedErrors = nil
+	se.Attachments = nil
+	se.CollapsedStacks = 0
+	return nil
+}
+
+// UnmarshalError unmarshals a stackerr.Error from its JSON form. An error is
+// returned if the JSON is invalid or has an unsupported schema version.
+func UnmarshalError(data []byte) (Error, error) {
+	se := &stackError{}
+	if err := se.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return se, nil
 }
 
 func (se *stackError) clone() *stackError {
 	newStackError := &stackError{
-		Err:         se.Err,
-		StackTraces: make(Stacks, len(se.StackTraces)),
-		MetaFields:  map[string]any{},
+		Err:             se.Err,
+		StackTraces:     make(Stacks, len(se.StackTraces)),
+		MetaFields:      map[string]any{},
+		Level:           se.Level,
+		PrivateKeys:     se.PrivateKeys,
+		RelatedErrors:   se.RelatedErrors,
+		Attachments:     se.Attachments,
+		CollapsedStacks: se.CollapsedStacks,
+		Kinds:           se.Kinds,
+		StackMetas:      se.StackMetas,
+		RecoveredValue:  se.RecoveredValue,
 	}
 	copy(newStackError.StackTraces, se.StackTraces)
 	for k, v := range se.MetaFields {
@@ -80,28 +521,173 @@ func (se *stackError) clone() *stackError {
 	return newStackError
 }
 
+func (se *stackError) forkFields() *stackError {
+	newStackError := &stackError{
+		Err:             se.Err,
+		StackTraces:     se.StackTraces,
+		MetaFields:      make(map[string]any, len(se.MetaFields)),
+		Level:           se.Level,
+		PrivateKeys:     se.PrivateKeys,
+		RelatedErrors:   se.RelatedErrors,
+		Attachments:     se.Attachments,
+		CollapsedStacks: se.CollapsedStacks,
+		Kinds:           se.Kinds,
+		StackMetas:      se.StackMetas,
+		RecoveredValue:  se.RecoveredValue,
+	}
+	for k, v := range se.MetaFields {
+		newStackError.MetaFields[k] = v
+	}
+	return newStackError
+}
+
 func (se *stackError) ErrorWithStack() string {
 	return se.Error() + "\n" + se.FormatStacks()
 }
 
+func (se *stackError) FormatFull() string {
+	res := se.Error() + "\n"
+	if len(se.MetaFields) > 0 {
+		res += "Fields:\n"
+		for _, field := range se.SortedFields() {
+			res += fmt.Sprintf("  %s: %v\n", field.Key, field.Value)
+		}
+	}
+	return res + se.FormatStacks()
+}
+
+func (se *stackError) SortedFields() []Field {
+	fields := make([]Field, 0, len(se.MetaFields))
+	for k, v := range se.MetaFields {
+		fields = append(fields, Field{
+			Key:   k,
+			Value: v,
+		})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Key < fields[j].Key
+	})
+	return fields
+}
+
 func (se *stackError) Error() string {
-	return se.Err.Error()
+	message := se.Err.Error()
+	if maxBytes := int(maxMessageBytes.Load()); maxBytes > 0 && len(message) > maxBytes {
+		return truncateString(message, maxBytes)
+	}
+	return message
+}
+
+func (se *stackError) Summary() string {
+	message := strings.Join(strings.Fields(se.Error()), " ")
+	if len(se.StackTraces) == 0 {
+		return message
+	}
+	top, ok := se.resolvedStacks()[0].Top()
+	if !ok {
+		return message
+	}
+	return fmt.Sprintf("%s (%s at %s:%d)", message, ShortFuncName(top.Function), filepath.Base(top.File), top.Line)
+}
+
+func (se *stackError) SafeError() string {
+	return redactMessage(se.Error())
 }
 
 func (se *stackError) Stacks() Stacks {
-	return se.StackTraces
+	return se.resolvedStacks()
+}
+
+func (se *stackError) StackCapturedAt() []time.Time {
+	times := make([]time.Time, len(se.StackTraces))
+	for i := range times {
+		times[i] = se.StackMetas.at(i).CapturedAt
+	}
+	return times
+}
+
+func (se *stackError) StackLabels() []string {
+	labels := make([]string, len(se.StackTraces))
+	for i := range labels {
+		labels[i] = se.StackMetas.at(i).Label
+	}
+	return labels
+}
+
+func (se *stackError) InvolvedFunctions() []string {
+	functions := []string{}
+	seen := map[string]struct{}{}
+	for _, stack := range se.resolvedStacks() {
+		for _, frame := range stack.trimStack() {
+			if strings.HasPrefix(frame.Function, "runtime.") {
+				continue
+			}
+			if _, ok := seen[frame.Function]; !ok {
+				functions = append(functions, frame.Function)
+				seen[frame.Function] = struct{}{}
+			}
+		}
+	}
+	return functions
 }
 
 func (se *stackError) Unwrap() error {
 	return se.Err
 }
 
+// Is and As only look at the wrapped error itself, since errors.Is and errors.As
+// already traverse the chain through Unwrap (following it here too would
+// search the rest of the chain again for each stackerr.Error in it).
+func (se *stackError) Is(target error) bool {
+	if se.Err == nil {
+		return false
+	}
+	if target != nil && reflect.TypeOf(target).Comparable() && se.Err == target {
+		return true
+	}
+	x, ok := se.Err.(interface{ Is(error) bool })
+	return ok && x.Is(target)
+}
+
+func (se *stackError) As(target any) bool {
+	if se.Err == nil {
+		return false
+	}
+	val := reflect.ValueOf(target)
+	if val.Kind() != reflect.Pointer || val.IsNil() {
+		return false
+	}
+	if reflect.TypeOf(se.Err).AssignableTo(val.Type().Elem()) {
+		val.Elem().Set(reflect.ValueOf(se.Err))
+		return true
+	}
+	x, ok := se.Err.(interface{ As(any) bool })
+	return ok && x.As(target)
+}
+
 func (se *stackError) FormatStacks() string {
-	return se.StackTraces.Format()
+	return formatStacks(se.resolvedStacks(), se.StackMetas)
+}
+
+func (se *stackError) FormatStacksNormalized(opts ...NormalizeOption) string {
+	return formatStacks(se.resolvedStacks().Normalize(opts...), se.StackMetas)
+}
+
+func (se *stackError) FormatStacksDedup() string {
+	// The stacks are resolved, so they can be compared by their frames
+	stacks := se.resolvedStacks()
+	return formatStacks(pickStacks(stacks, se.StackMetas, stacks.distinctIndices(nil)))
+}
+
+// formatStacks formats stacks into a human-readable string, with their labels.
+func formatStacks(stacks Stacks, metas stackMetas) string {
+	sb := &strings.Builder{}
+	stacks.writeFormattedWithMeta(sb, metas)
+	return sb.String()
 }
 
 func (se *stackError) FormatStacksJson() string {
-	b, _ := json.Marshal(se.StackTraces)
+	b, _ := json.Marshal(se.resolvedStacks())
 	return string(b)
 }
 
@@ -119,37 +705,268 @@ func (se *stackError) WithSingle(key string, value any) Error {
 	return newStackError
 }
 
+func (se *stackError) WithAppendField(key string, value any) Error {
+	newStackError := se.clone()
+	var values []any
+	switch existing := se.MetaFields[key].(type) {
+	case nil:
+		if _, ok := se.MetaFields[key]; ok {
+			values = []any{nil}
+		}
+	case []any:
+		values = existing
+	default:
+		values = []any{existing}
+	}
+	// Make a new slice, since the existing one is shared with the original error
+	appended := make([]any, len(values), len(values)+1)
+	copy(appended, values)
+	newStackError.MetaFields[key] = append(appended, value)
+	return newStackError
+}
+
+func (se *stackError) WithIf(cond bool, keyValuePairs map[string]any) Error {
+	if !cond {
+		return se
+	}
+	return se.With(keyValuePairs)
+}
+
+func (se *stackError) ForkFields() Error {
+	return se.forkFields()
+}
+
+func (se *stackError) CollapseSelfWraps() Error {
+	newStackError := se.clone()
+	newStackError.StackTraces, newStackError.StackMetas = pickStacks(se.StackTraces, se.StackMetas, se.StackTraces.collapseSelfWrapsIndices())
+	for k, v := range newStackError.MetaFields {
+		if values, ok := v.([]any); ok {
+			newStackError.MetaFields[k] = collapseRepeatedValues(values)
+		}
+	}
+	return newStackError
+}
+
+// collapseRepeatedValues collapses runs of consecutive equal values into a single value.
+func collapseRepeatedValues(values []any) []any {
+	collapsed := make([]any, 0, len(values))
+	for i, v := range values {
+		if i > 0 && reflect.DeepEqual(v, values[i-1]) {
+			continue
+		}
+		collapsed = append(collapsed, v)
+	}
+	return collapsed
+}
+
+func (se *stackError) ToECS() map[string]any {
+	ecs := make(map[string]any, 3+len(se.MetaFields))
+	ecs["error.message"] = se.Error()
+	ecs["error.type"] = fmt.Sprintf("%T", se.Err)
+	ecs["error.stack_trace"] = se.FormatStacks()
+	for k, v := range se.MetaFields {
+		ecs["labels."+k] = v
+	}
+	return ecs
+}
+
+func (se *stackError) TranslateTo(newErr error, keepInChain bool) Error {
+	newStackError := se.clone()
+	if keepInChain && se.Err != nil {
+		newStackError.Err = &translatedError{
+			err:      newErr,
+			original: se.Err,
+		}
+	} else {
+		newStackError.Err = newErr
+	}
+	return newStackError
+}
+
+func (se *stackError) PanicValue() (any, bool) {
+	if se.RecoveredValue != nil {
+		return se.RecoveredValue, true
+	}
+	v, ok := se.MetaFields[PanicValueField]
+	return v, ok
+}
+
+func (se *stackError) WithSeverity(level Severity) Error {
+	newStackError := se.clone()
+	newStackError.Level = level
+	return newStackError
+}
+
+func (se *stackError) WithoutStacks() Error {
+	newStackError := se.clone()
+	newStackError.StackTraces = Stacks{}
+	newStackError.StackMetas = nil
+	return newStackError
+}
+
+func (se *stackError) WithFieldVisibility(key string, public bool) Error {
+	newStackError := se.clone()
+	// Make a new set of private keys, since the existing one may be shared
+	privateKeys := make(map[string]struct{}, len(se.PrivateKeys)+1)
+	for k := range se.PrivateKeys {
+		privateKeys[k] = struct{}{}
+	}
+	if public {
+		delete(privateKeys, key)
+	} else {
+		privateKeys[key] = struct{}{}
+	}
+	newStackError.PrivateKeys = privateKeys
+	return newStackError
+}
+
+func (se *stackError) WithRelated(related error) Error {
+	newStackError := se.clone()
+	// Make a new slice, since the existing one may be shared
+	relatedErrors := make([]error, len(se.RelatedErrors), len(se.RelatedErrors)+1)
+	copy(relatedErrors, se.RelatedErrors)
+	newStackError.RelatedErrors = append(relatedErrors, related)
+	return newStackError
+}
+
+func (se *stackError) Related() []error {
+	return se.RelatedErrors
+}
+
+// Whether editing a frozen error in place panics, instead of doing nothing
+var panicOnFrozenEdit atomic.Bool
+
+// SetPanicOnFrozenEdit sets whether calling the InPlaceEditError methods of a
+// frozen stackerr.Error (see Error.Freeze) panics. If false, they do nothing.
+// Defaults to false.
+func SetPanicOnFrozenEdit(panicOnEdit bool) {
+	panicOnFrozenEdit.Store(panicOnEdit)
+}
+
+// editable checks whether the error can be edited in place, and panics
+// if it's frozen and SetPanicOnFrozenEdit is enabled.
+func (se *stackError) editable() bool {
+	if !se.Frozen {
+		return true
+	}
+	if panicOnFrozenEdit.Load() {
+		panic("stackerr: in-place edit of a frozen error")
+	}
+	return false
+}
+
+func (se *stackError) CollapsedStackCount() int {
+	return se.CollapsedStacks
+}
+
+func (se *stackError) WithAttachment(name string, data []byte) Error {
+	newStackError := se.clone()
+	// Make a new map, since the existing one may be shared
+	attachments := make(map[string][]byte, len(se.Attachments)+1)
+	for k, v := range se.Attachments {
+		attachments[k] = v
+	}
+	attachments[name] = data
+	newStackError.Attachments = attachments
+	return newStackError
+}
+
+func (se *stackError) Attachment(name string) ([]byte, bool) {
+	data, ok := se.Attachments[name]
+	return data, ok
+}
+
+func (se *stackError) Freeze() Error {
+	newStackError := se.clone()
+	newStackError.Frozen = true
+	return newStackError
+}
+
 func (se *stackError) WithInPlace(keyValuePairs map[string]any) {
+	if !se.editable() {
+		return
+	}
+	if se.MetaFields == nil && len(keyValuePairs) > 0 {
+		se.MetaFields = make(map[string]any, len(keyValuePairs))
+	}
 	for k, v := range keyValuePairs {
 		se.MetaFields[k] = v
 	}
 }
 
 func (se *stackError) SetError(err error) {
+	if !se.editable() {
+		return
+	}
 	se.Err = err
 }
 
 func (se *stackError) SetStacks(stacks Stacks) {
+	if !se.editable() {
+		return
+	}
 	se.StackTraces = stacks
+	se.StackMetas = nil
 }
 
 func (se *stackError) Fields() map[string]any {
+	// The fields map isn't allocated until there are fields
+	if se.MetaFields == nil {
+		return map[string]any{}
+	}
 	return se.MetaFields
 }
 
 // FromRecover converts a panic recover() result
 // into a stackerr.Error, using the stack at the
-// point where the panic was created.s
+// point where the panic was created. It must be
+// called directly in the deferred function that
+// calls recover(), for example:
+//
+//	defer func() {
+//		if err := stackerr.FromRecover(recover()); err != nil {
+//			...
+//		}
+//	}()
+//
+// If it's called from a helper function instead,
+// use FromRecoverSkip.
 func FromRecover(r any) Error {
+	return fromRecover(r, 3)
+}
+
+// FromRecoverSkip is like FromRecover, but ignores an additional
+// `skippedFrames` frames of the stack. This allows FromRecover
+// to be called from helper functions, e.g. a skip of 1 for a helper
+// that is called directly in the deferred function.
+func FromRecoverSkip(r any, skippedFrames int) Error {
+	return fromRecover(r, 3+skippedFrames)
+}
+
+// PanicValueField is the reserved field that FromRecover and FromRecoverSkip
+// use to store the string form of the value that was recovered from a panic
+// (see Error.PanicValue for the raw value).
+const PanicValueField string = "panic_value"
+
+func fromRecover(r any, skippedFrames int) Error {
 	if r == nil {
 		return nil
 	}
+	var serr *stackError
 	switch e := r.(type) {
 	case error:
-		return new(e, 3, true)
+		serr = wrapError(e, 1+skippedFrames, true, collapseParentStacks.Load())
 	default:
-		return new(fmt.Errorf("%v", r), 3, true)
+		serr = wrapError(fmt.Errorf("%v", r), 1+skippedFrames, true, collapseParentStacks.Load())
 	}
+	// Keep the original value, since it may have
+	// more information than its string form
+	serr.RecoveredValue = r
+	serr.WithInPlace(map[string]any{
+		PanicValueField: serr.Err.Error(),
+	})
+	runWrapHooks(serr)
+	return serr
 }
 
 // Wrap wraps an error into a stackerr.Error, using
@@ -158,6 +975,158 @@ func Wrap(err error) Error {
 	return new(err, 1, true)
 }
 
+// WrapSeverity wraps an error into a stackerr.Error with the given severity level,
+// using the stack trace at the point where this function was called. If the severity
+// is below the minimum set with SetMinStackCaptureSeverity, no stack is captured.
+func WrapSeverity(level Severity, err error) Error {
+	se := wrapErrorWithSeverity(err, 1, true, collapseParentStacks.Load(), level, nil)
+	if se == nil {
+		return nil
+	}
+	runWrapHooks(se)
+	return se
+}
+
+// WrapLabeled wraps an error into a stackerr.Error, using the stack trace at the
+// point where this function was called, and labels that stack with the name of
+// the layer that wrapped it (e.g. "handler" or "repository"). See Error.StackLabels.
+// The labeled stack is kept even if it's the parent of an existing stack, but like
+// any other stack, a later wrap that collapses parent stacks may remove it.
+func WrapLabeled(label string, err error) Error {
+	if err == nil {
+		return nil
+	}
+	stack, meta := captureStack(1)
+	if stack == nil {
+		return new(err, 1, true)
+	}
+	meta.Label = label
+	se := wrapErrorWithSeverity(err, 1, true, false, severityUnset, stackMetas{meta}, stack)
+	// The existing stacks are collapsed as usual, but the labeled stack is kept even if
+	// it's the parent of an existing stack, since the label is information of its own
+	if collapseParentStacks.Load() && len(se.StackTraces) > 2 {
+		existing, existingMetas := removeParentStacks(se.StackTraces[1:], se.StackMetas.slice(1, len(se.StackMetas)))
+		se.CollapsedStacks += len(se.StackTraces) - 1 - len(existing)
+		se.StackTraces, se.StackMetas = concatStacks(se.StackTraces[:1], se.StackMetas.slice(0, 1), existing, existingMetas)
+	}
+	runWrapHooks(se)
+	return se
+}
+
+// BadKVField is the reserved field that WrapKV uses to store an argument that isn't
+// part of a valid key-value pair (e.g. the last argument of an odd-length list).
+const BadKVField string = "!BADKV"
+
+// WrapKV wraps an error into a stackerr.Error, using the stack trace at the point
+// where this function was called, with fields from alternating keys and values, e.g.
+// WrapKV(err, "user", id, "op", "delete"). As with log/slog, it doesn't panic on
+// invalid input: a key that isn't a string, or a final key without a value, is
+// stored in the BadKVField field instead.
+func WrapKV(err error, kv ...any) Error {
+	se := wrapError(err, 1, true, collapseParentStacks.Load())
+	if se == nil {
+		return nil
+	}
+	fields := make(map[string]any, (len(kv)+1)/2)
+	for i := 0; i < len(kv); {
+		key, ok := kv[i].(string)
+		if !ok || i+1 >= len(kv) {
+			fields[BadKVField] = kv[i]
+			i++
+			continue
+		}
+		fields[key] = kv[i+1]
+		i += 2
+	}
+	se.WithInPlace(fields)
+	runWrapHooks(se)
+	return se
+}
+
+// GoWrap wraps an error that occurred in a goroutine into a stackerr.Error, using the
+// stack trace at the point where this function was called, and adds `parentStack` as
+// the oldest stack to show where the goroutine was launched. The parent stack should
+// be captured (e.g. with StackTrace) before launching the goroutine:
+//
+//	parentStack := stackerr.StackTrace()
+//	go func() {
+//		if err := work(); err != nil {
+//			errs <- stackerr.GoWrap(parentStack, err)
+//		}
+//	}()
+func GoWrap(parentStack Stack, err error) Error {
+	se := wrapError(err, 1, true, collapseParentStacks.Load())
+	if se == nil {
+		return nil
+	}
+	if len(parentStack) > 0 {
+		stack, meta := offloadStack(parentStack, stackMeta{})
+		se.StackTraces, se.StackMetas = concatStacks(se.StackTraces, se.StackMetas, Stacks{stack}, stackMetas(nil).set(1, 0, meta))
+	}
+	runWrapHooks(se)
+	return se
+}
+
+// ReStack converts an error into a stackerr.Error that keeps its message and fields,
+// but whose stacks are replaced by the single stack at the point where this function
+// was called, e.g. when re-returning an error whose original stacks are irrelevant.
+func ReStack(err error) Error {
+	if err == nil {
+		return nil
+	}
+	stacks := Stacks{}
+	var metas stackMetas
+	if stack, meta := captureStack(1); stack != nil {
+		stacks = Stacks{stack}
+		metas = metas.set(1, 0, meta)
+	}
+	se := wrapErrorWithSeverity(err, 1, false, false, severityUnset, metas, stacks...)
+	se.StackTraces = se.StackTraces[:len(stacks)]
+	se.StackMetas = se.StackMetas.slice(0, len(stacks))
+	runWrapHooks(se)
+	return se
+}
+
+// WrapOnce wraps an error into a stackerr.Error, using the stack trace at the point
+// where this function was called, unless the error's newest stack already
+// originates at the same call site (e.g. in retried or recursive code). In that
+// case no stack is added, and a stackerr.Error is returned unchanged.
+func WrapOnce(err error) Error {
+	return wrapOnce(err, 1)
+}
+
+// Return wraps an error into a stackerr.Error at a return site, e.g.
+//
+//	if err != nil {
+//		return stackerr.Return(err)
+//	}
+//
+// It's the same as WrapOnce, so an error that is returned again from the
+// same line (e.g. in a retry loop) doesn't get a duplicate stack.
+func Return(err error) Error {
+	return wrapOnce(err, 1)
+}
+
+// wrapOnce wraps an error unless its newest stack already originates at the
+// call site, which is `skippedFrames` frames above the caller of this function.
+func wrapOnce(err error, skippedFrames int) Error {
+	if err == nil {
+		return nil
+	}
+	stacks := chainStacks(err)
+	if len(stacks) > 0 {
+		top, ok := stacks[0].Top()
+		pc, file, line, _ := runtime.Caller(1 + skippedFrames)
+		if ok && top.File == file && top.Line == line && top.Function == runtime.FuncForPC(pc).Name() {
+			if serr, ok := err.(*stackError); ok {
+				return serr
+			}
+			return new(err, 1+skippedFrames, false)
+		}
+	}
+	return new(err, 1+skippedFrames, true)
+}
+
 // WrapWithFrameSkips wraps an error into a stackerr.Error, ignoring
 // the most recent `skippedFrames` frames of the stack.
 func WrapWithFrameSkips(err error, skippedFrames int) Error {
@@ -170,6 +1139,81 @@ func WrapWithStack(err error, stack Stack) Error {
 	return new(err, 1, true, stack)
 }
 
+// WrapWithStacks wraps an error into a stackerr.Error, using the given
+// stacks as the stackerr.Error's stack traces, with any duplicate stacks
+// and stacks that are parents of other stacks removed. If no stacks are
+// given, the stack trace at the point where this function was called is used.
+func WrapWithStacks(err error, stacks Stacks) Error {
+	// Remove duplicates first, since RemoveParents treats
+	// duplicate stacks as parents of each other
+	se := wrapError(err, 1, true, collapseParentStacks.Load(), stacks.Distinct()...)
+	if se == nil {
+		return nil
+	}
+	se.StackTraces, se.StackMetas = distinctStacks(se.StackTraces, se.StackMetas)
+	runWrapHooks(se)
+	return se
+}
+
+// WrapFrom wraps an error into a stackerr.Error, using the stack trace
+// starting at the caller of the function `marker`, which must be a function
+// value. This allows helper functions to attribute errors to their callers
+// without counting frames, e.g. by passing the helper function itself as the
+// marker. If the marker is not found in the stack, the stack trace at the
+// point where this function was called is used.
+func WrapFrom(marker any, err error) Error {
+	if err == nil {
+		return nil
+	}
+	stack, meta := captureStack(1)
+	if stack == nil {
+		return new(err, 1, true)
+	}
+	if v := reflect.ValueOf(marker); v.Kind() == reflect.Func {
+		if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+			name := fn.Name()
+			markerIdx := -1
+			for i, frame := range stack {
+				if frame.Function == name {
+					markerIdx = i
+				} else if markerIdx >= 0 {
+					// Only skip past the first (possibly recursive) run of the marker
+					break
+				}
+			}
+			if markerIdx >= 0 {
+				stack = stack[markerIdx+1:]
+			}
+		}
+	}
+	se := wrapErrorWithSeverity(err, 1, true, collapseParentStacks.Load(), severityUnset, stackMetas{meta}, stack)
+	runWrapHooks(se)
+	return se
+}
+
+// WrapWithStackFromError wraps an error into a stackerr.Error, using the
+// stacks of `stackSource` (from any stackerr.Error or "github.com/pkg/errors"
+// stack error in its chain) as the stackerr.Error's stack traces. This keeps
+// the original location of an error when replacing it with a new error. If
+// `stackSource` has no stacks, the stack trace at the point where this function
+// was called is used.
+func WrapWithStackFromError(err error, stackSource error) Error {
+	return new(err, 1, true, chainStacks(stackSource)...)
+}
+
+// WrapKeepingAllStacks wraps an error into a stackerr.Error, using
+// the stack trace at the point where this function was called. Unlike
+// Wrap, it keeps all existing stacks, even if they are parents of other
+// stacks, regardless of SetCollapseParentStacks.
+func WrapKeepingAllStacks(err error) Error {
+	se := wrapError(err, 1, true, false)
+	if se == nil {
+		return nil
+	}
+	runWrapHooks(se)
+	return se
+}
+
 // WrapWithoutExtraStack wraps an error into a stackerr.Error. If the
 // error being wrapped already has a stack, no additional stack will be
 // added. If it doesn't, the current stack will be added.
@@ -177,6 +1221,20 @@ func WrapWithoutExtraStack(err error) Error {
 	return new(err, 1, false)
 }
 
+// AsStackErr converts an error into a stackerr.Error that can be edited in place.
+// If the error already is one, it's returned as-is. Otherwise, it's wrapped as with
+// WrapWithoutExtraStack, and the wrapper is returned. The boolean is false if the
+// error is nil.
+func AsStackErr(err error) (InPlaceEditError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	if serr, ok := err.(*stackError); ok {
+		return serr, true
+	}
+	return new(err, 1, false).(*stackError), true
+}
+
 // WrapWithFrameSkipsWithoutExtraStack wraps an error into a stackerr.Error, ignoring
 // the most recent `skippedFrames` frames of the stack. If the
 // error being wrapped already has a stack, no additional stack will be
@@ -185,29 +1243,259 @@ func WrapWithFrameSkipsWithoutExtraStack(err error, skippedFrames int) Error {
 	return new(err, 1+skippedFrames, false)
 }
 
+// The maximum number of errors in a chain that are checked for stacks when wrapping (0 for no maximum)
+var maxWrapDepth atomic.Int64
+
+// SetMaxWrapDepth sets the maximum number of errors in an error's chain that are
+// checked for existing stacks and fields when wrapping it. Errors further down
+// the chain are ignored, which bounds the cost of wrapping errors with very
+// long chains (e.g. from repeatedly wrapping an error in a retry loop). A value
+// of 0 (the default) means there is no maximum.
+func SetMaxWrapDepth(n int) {
+	maxWrapDepth.Store(int64(n))
+}
+
+// sameError checks whether two errors are the same (without panicking if they aren't comparable).
+// The values are checked rather than the types, since a comparable struct type can still hold
+// an uncomparable value in an interface field.
+func sameError(a, b error) bool {
+	if a == nil || b == nil || !reflect.ValueOf(a).Comparable() || !reflect.ValueOf(b).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// Whether stacks that are parents of other stacks should be removed when wrapping
+var collapseParentStacks = newAtomicBool(true)
+
+// SetCollapseParentStacks sets whether, when wrapping an error (or adding a stack with
+// Stacks.Prepend or Stacks.Append), any stacks that are parents of other stacks (see
+// Stack.IsParentOf) should be removed. Defaults to true.
+func SetCollapseParentStacks(collapse bool) {
+	collapseParentStacks.Store(collapse)
+}
+
+// Whether stacks of "github.com/pkg/errors" errors should be imported when wrapping
+var importPkgErrorsStacks = newAtomicBool(true)
+
+// SetImportPkgErrorsStacks sets whether, when wrapping an error, the stacks of any
+// "github.com/pkg/errors" errors in its chain should be converted and included in
+// the stackerr.Error. If false, they're ignored and only stacks captured by this
+// package are used. Defaults to true.
+func SetImportPkgErrorsStacks(importStacks bool) {
+	importPkgErrorsStacks.Store(importStacks)
+}
+
+// The minimum severity of errors that stacks are captured for (the zero
+// value, severityUnset, is lower than every severity, like SeverityDebug)
+var minStackCaptureSeverity atomic.Int64
+
+// SetMinStackCaptureSeverity sets the minimum severity of errors that a stack is
+// captured for when wrapping (e.g. by Wrap or Errorf). Errors that have a lower
+// severity (set before wrapping, e.g. with WrapSeverity) keep their message and
+// fields, but no new stack is captured for them. Errors without a severity always
+// have their stack captured. Defaults to SeverityDebug, i.e. stacks are always captured.
+func SetMinStackCaptureSeverity(level Severity) {
+	minStackCaptureSeverity.Store(int64(level))
+}
+
+// Whether stacks are captured when wrapping
+var stackCaptureEnabled = newAtomicBool(true)
+
+// SetStackCaptureEnabled sets whether a stack is captured when wrapping (e.g. by
+// Wrap, Errorf, WrapLabeled, or ReStack) or by StackTrace. If disabled, new errors
+// keep their message and fields, but have no stacks unless they're given explicitly
+// (e.g. with WrapWithStack). Defaults to true.
+func SetStackCaptureEnabled(enabled bool) {
+	stackCaptureEnabled.Store(enabled)
+}
+
+// captureStackForSeverity checks whether a stack should be captured for an error with
+// the given severity, according to SetStackCaptureEnabled and SetMinStackCaptureSeverity.
+func captureStackForSeverity(level Severity) bool {
+	return stackCaptureEnabled.Load() && (level == severityUnset || level >= Severity(minStackCaptureSeverity.Load()))
+}
+
+// The maximum capacity of a stack buffer that will be returned to the pool,
+// so that the pool doesn't hold onto unusually large buffers
+const maxPooledStackBufferCap int = 16
+
+// A pool of buffers for collecting existing stacks while wrapping errors
+var stackBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]Stack, 0, 4)
+		return &buf
+	},
+}
+
+func releaseStackBuffer(buf *[]Stack, used []Stack) {
+	if cap(used) > maxPooledStackBufferCap {
+		return
+	}
+	// Clear the stacks so the pool doesn't keep them alive
+	for i := range used {
+		used[i] = nil
+	}
+	*buf = used[:0]
+	stackBufferPool.Put(buf)
+}
+
 type stackTracer interface {
 	StackTrace() nativeStackErrors.StackTrace
 }
 
+// stackTracerStack converts the stack of a "github.com/pkg/errors" stack error.
+func stackTracerStack(st stackTracer) Stack {
+	stack := st.StackTrace()
+	uintptrs := make([]uintptr, len(stack))
+	for i, v := range stack {
+		uintptrs[i] = uintptr(v)
+	}
+	return uintptrToFrames(uintptrs)
+}
+
+// chainStacks gets the stacks in an error's chain, from any stackerr.Error
+// (which already includes the stacks of errors it wraps) or
+// "github.com/pkg/errors" stack errors. Offloaded stacks are retrieved
+// from the stack store.
+func chainStacks(err error) Stacks {
+	stacks := Stacks{}
+	walkChain(err, func(err error) bool {
+		if serr, ok := err.(*stackError); ok {
+			stacks = append(stacks, serr.resolvedStacks()...)
+			return false
+		} else if st, ok := err.(stackTracer); ok && importPkgErrorsStacks.Load() {
+			stacks = append(stacks, stackTracerStack(st))
+		}
+		return true
+	})
+	return stacks
+}
+
 func new(err error, skippedFrames int, addStackToExisting bool, newStacks ...Stack) Error {
+	se := wrapError(err, 1+skippedFrames, addStackToExisting, collapseParentStacks.Load(), newStacks...)
+	if se == nil {
+		return nil
+	}
+	runWrapHooks(se)
+	return se
+}
+
+// wrapError creates a new stackError, without running the wrap hooks. This allows callers
+// to finish setting up the error before the hooks are run.
+func wrapError(err error, skippedFrames int, addStackToExisting bool, removeParents bool, newStacks ...Stack) *stackError {
+	return wrapErrorWithSeverity(err, 1+skippedFrames, addStackToExisting, removeParents, severityUnset, nil, newStacks...)
+}
+
+// wrapErrorWithSeverity is the same as wrapError, except that the new stackError has
+// the given severity (unless it's unset), which is also used to decide whether a stack
+// should be captured (see SetMinStackCaptureSeverity). The new stacks have the
+// given metadata, which may be nil if none of them have any.
+func wrapErrorWithSeverity(err error, skippedFrames int, addStackToExisting bool, removeParents bool, severity Severity, newMetas stackMetas, newStacks ...Stack) *stackError {
 	// If it's nil, just return nil, since it's not a real error
 	if err == nil {
 		return nil
 	}
 
-	numAllstacks := 1
-	if len(newStacks) > numAllstacks {
-		numAllstacks = len(newStacks)
+	// If it's already a stack error with stacks and we're not adding any,
+	// the result is a copy of it, so there's no need to walk the chain
+	if serr, ok := err.(*stackError); ok && !addStackToExisting && len(newStacks) == 0 && len(serr.StackTraces) > 0 {
+		return rewrapStackError(serr, removeParents, severity)
+	}
+	return wrapErrorChain(err, 1+skippedFrames, addStackToExisting, removeParents, severity, newMetas, newStacks...)
+}
+
+// rewrapStackError is the fast path of wrapErrorWithSeverity, for wrapping a stack error
+// that already has stacks without adding any. It has the same result as wrapErrorChain.
+func rewrapStackError(serr *stackError, removeParents bool, severity Severity) *stackError {
+	stacks, metas := serr.StackTraces, serr.StackMetas
+	collapsed := serr.CollapsedStacks
+	if removeParents && len(stacks) > 1 {
+		stacks, metas = removeParentStacks(stacks, metas)
+		collapsed += len(serr.StackTraces) - len(stacks)
+	}
+	var fields map[string]any
+	if len(serr.MetaFields) > 0 {
+		fields = make(map[string]any, len(serr.MetaFields))
+		for k, v := range serr.MetaFields {
+			fields[k] = v
+		}
 	}
-	allStacks := make([]Stack, 0, numAllstacks)
+	level := serr.Level
+	if severity != severityUnset {
+		level = severity
+	}
+	return &stackError{
+		serr.Err,
+		stacks,
+		fields,
+		level,
+		serr.PrivateKeys,
+		serr.RelatedErrors,
+		false,
+		serr.Attachments,
+		collapsed,
+		serr.Kinds,
+		metas,
+		serr.RecoveredValue,
+	}
+}
+
+// wrapErrorChain is the slow path of wrapErrorWithSeverity, which walks the error's chain
+// to collect the existing stacks and fields.
+func wrapErrorChain(err error, skippedFrames int, addStackToExisting bool, removeParents bool, severity Severity, newMetas stackMetas, newStacks ...Stack) *stackError {
+	// Collect the stacks that already exist in the chain into a pooled buffer,
+	// since they'll be copied into the final (exactly-sized) slice of stacks
+	existingBuffer := stackBufferPool.Get().(*[]Stack)
+	existingStacks := (*existingBuffer)[:0]
+	defer func() {
+		releaseStackBuffer(existingBuffer, existingStacks)
+	}()
 
-	allFields := map[string]any{}
+	// The fields map is only allocated if there are fields to keep
+	var allFields map[string]any
+	level := severityUnset
+	var privateKeys map[string]struct{}
+	var relatedErrors []error
+	var attachments map[string][]byte
+	var kinds map[reflect.Type]any
+	var recovered any
+	var existingMetas stackMetas
+	collapsed := 0
+	maxDepth := int(maxWrapDepth.Load())
 	unwrapped := err
-	for unwrapped != nil {
+	// An error that moves down the chain at half the speed, to detect cycles
+	slow := err
+	for depth := 0; unwrapped != nil; depth++ {
+		// Stop if the chain is too deep, or if it's a cycle
+		if maxDepth > 0 && depth >= maxDepth {
+			break
+		}
+		if depth > 0 && sameError(unwrapped, slow) {
+			break
+		}
+		if depth%2 == 1 {
+			slow = errors.Unwrap(slow)
+		}
+
 		// Check if it's a stack error
 		if serr, ok := unwrapped.(*stackError); ok {
-			allStacks = append(allStacks, serr.StackTraces...)
+			if serr.StackMetas != nil {
+				existingMetas = make(stackMetas, len(existingStacks), len(existingStacks)+len(serr.StackMetas))
+				existingMetas = append(existingMetas, serr.StackMetas...)
+			}
+			existingStacks = append(existingStacks, serr.StackTraces...)
+			level = serr.Level
+			privateKeys = serr.PrivateKeys
+			relatedErrors = serr.RelatedErrors
+			attachments = serr.Attachments
+			collapsed = serr.CollapsedStacks
+			kinds = serr.Kinds
+			recovered = serr.RecoveredValue
 			for k, v := range serr.MetaFields {
+				if allFields == nil {
+					allFields = make(map[string]any, len(serr.MetaFields))
+				}
 				// Only add it if we don't already have the same key,
 				// since we're starting with the outermost wrapper
 				// (and outermost has key priority)
@@ -218,48 +1506,66 @@ func new(err error, skippedFrames int, addStackToExisting bool, newStacks ...Sta
 			// Since any stack error will have already checked
 			// wrapped errors below it, we can stop here.
 			break
-		} else if st, ok := unwrapped.(stackTracer); ok {
+		} else if st, ok := unwrapped.(stackTracer); ok && importPkgErrorsStacks.Load() {
 			// If it's an "github.com/pkg/errors" stack error, convert it
-			stack := st.StackTrace()
-			uintptrs := make([]uintptr, len(stack))
-			for i, v := range stack {
-				uintptrs[i] = uintptr(v)
-			}
-			allStacks = append(allStacks, uintptrToFrames(uintptrs))
+			existingStacks = append(existingStacks, stackTracerStack(st))
 		}
 
 		unwrapped = errors.Unwrap(unwrapped)
 	}
 
-	// If there are any explicitly specified new stacks, add them
+	if severity != severityUnset {
+		level = severity
+	}
+
+	var allStacks Stacks
+	var allMetas stackMetas
 	if len(newStacks) > 0 {
-		allStacks = append(newStacks, allStacks...)
-	} else if len(allStacks) == 0 || addStackToExisting {
+		// If there are any explicitly specified new stacks, add them
+		stacks := make(Stacks, len(newStacks))
+		var metas stackMetas
+		for i, stack := range newStacks {
+			stack, meta := offloadStack(stack, newMetas.at(i))
+			stacks[i] = stack
+			metas = metas.set(len(stacks), i, meta)
+		}
+		allStacks, allMetas = concatStacks(stacks, metas, existingStacks, existingMetas)
+	} else if (len(existingStacks) == 0 || addStackToExisting) && captureStackForSeverity(level) {
 		// Otherwise, if there are no existing stacks OR we're supposed to force-add a new stack,
 		// add the current stack
-		allStacks = append([]Stack{StackTraceWithSkippedFrames(1 + skippedFrames)}, allStacks...)
+		stack, meta := offloadStack(captureStack(1 + skippedFrames))
+		allStacks, allMetas = concatStacks(Stacks{stack}, stackMetas(nil).set(1, 0, meta), existingStacks, existingMetas)
+	} else {
+		allStacks, allMetas = concatStacks(nil, nil, existingStacks, existingMetas)
 	}
 
-	if len(allStacks) > 1 {
+	if removeParents && len(allStacks) > 1 {
 		// Only include distinct stacks
-		allStacks = NewStacks(allStacks).RemoveParents()
+		before := len(allStacks)
+		allStacks, allMetas = removeParentStacks(allStacks, allMetas)
+		collapsed += before - len(allStacks)
 	}
 
 	// If we're wrapping something that's already a stack error,
 	// don't double wrap it.
+	wrapped := err
 	if serr, ok := err.(*stackError); ok {
-		return &stackError{
-			serr.Err,
-			allStacks,
-			allFields,
-		}
+		wrapped = serr.Err
 	}
 
-	// Otherwise, create a new stack error
 	return &stackError{
-		err,
+		wrapped,
 		allStacks,
 		allFields,
+		level,
+		privateKeys,
+		relatedErrors,
+		false,
+		attachments,
+		collapsed,
+		kinds,
+		allMetas,
+		recovered,
 	}
 }
 
@@ -267,3 +1573,34 @@ func Errorf(format string, a ...interface{}) Error {
 	e := fmt.Errorf(format, a...)
 	return new(e, 1, true)
 }
+
+// Wrapf wraps an error into a stackerr.Error with an additional message,
+// using the stack trace at the point where this function was called.
+// The message is formatted according to the format specifier and is
+// prepended to the error's message (e.g. "message: error"), and the
+// error can still be unwrapped. If the error is nil, nil is returned.
+// This matches the behaviour of Wrapf from "github.com/pkg/errors".
+func Wrapf(err error, format string, a ...interface{}) Error {
+	if err == nil {
+		return nil
+	}
+	// Copy the arguments, since appending to `a` could write to the caller's array
+	args := make([]any, 0, len(a)+1)
+	args = append(append(args, a...), err)
+	e := fmt.Errorf(format+": %w", args...)
+	return new(e, 1, true)
+}
+
+// Reconstruct builds a stackerr.Error from its parts, e.g. for an error that
+// was parsed from logs. The error wraps a new error with the given message,
+// and has the given stacks and a copy of the given fields. No stack is
+// captured at the point where this function is called.
+func Reconstruct(message string, stacks Stacks, fields map[string]any) Error {
+	se := &stackError{
+		Err:         errors.New(message),
+		StackTraces: stacks,
+	}
+	se.WithInPlace(fields)
+	runWrapHooks(se)
+	return se
+}
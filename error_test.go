@@ -0,0 +1,1252 @@
+package stackerr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	nativeStackErrors "github.com/pkg/errors"
+)
+
+// valErr is an error with a comparable type that can hold an uncomparable value
+type valErr struct {
+	detail any
+	next   error
+}
+
+func (e valErr) Error() string {
+	return fmt.Sprintf("%v", e.detail)
+}
+
+func (e valErr) Unwrap() error {
+	return e.next
+}
+
+// cycleErr is an error whose chain can be made to loop back on itself
+type cycleErr struct {
+	name string
+	next error
+}
+
+func (e *cycleErr) Error() string {
+	return e.name
+}
+
+func (e *cycleErr) Unwrap() error {
+	return e.next
+}
+
+// newCycle creates a chain of errors where A wraps B, which wraps A
+func newCycle() error {
+	a := &cycleErr{name: "a"}
+	b := &cycleErr{name: "b", next: a}
+	a.next = b
+	return a
+}
+
+func TestWrapUncomparableError(t *testing.T) {
+	outer := valErr{[]string{"y"}, valErr{[]string{"x"}, nil}}
+	err := Wrap(outer)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(err.Stacks()) != 1 {
+		t.Fatalf("expected 1 stack, got %d", len(err.Stacks()))
+	}
+	if err.Error() != "[y]" {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+}
+
+func TestWrapCycle(t *testing.T) {
+	err := Wrap(newCycle())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(err.Stacks()) != 1 {
+		t.Fatalf("expected 1 stack, got %d", len(err.Stacks()))
+	}
+}
+
+func TestSelfWrappingIsBounded(t *testing.T) {
+	defer SetMaxWrapDepth(0)
+	SetMaxWrapDepth(4)
+
+	// Re-wrapping the same error in a loop doesn't grow its stacks
+	var err error = errors.New("rate limited")
+	for i := 0; i < 100; i++ {
+		err = Wrap(fmt.Errorf("retry %d: %w", i, err))
+	}
+	if n := len(err.(Error).Stacks()); n != 1 {
+		t.Fatalf("expected 1 stack, got %d", n)
+	}
+
+	// A chain deeper than the maximum isn't searched for existing stacks
+	var deep error = Wrap(errors.New("rate limited"))
+	for i := 0; i < 10; i++ {
+		deep = fmt.Errorf("layer %d: %w", i, deep)
+	}
+	if n := len(WrapKeepingAllStacks(deep).Stacks()); n != 1 {
+		t.Fatalf("expected only the new stack, got %d stacks", n)
+	}
+}
+
+func TestImportPkgErrorsStacks(t *testing.T) {
+	defer SetImportPkgErrorsStacks(true)
+	pkgErr := nativeStackErrors.New("pkg")
+
+	SetImportPkgErrorsStacks(true)
+	if n := len(WrapKeepingAllStacks(pkgErr).Stacks()); n != 2 {
+		t.Fatalf("expected the imported stack and the new stack, got %d stacks", n)
+	}
+	if n := len(WrapWithoutExtraStack(pkgErr).Stacks()); n != 1 {
+		t.Fatalf("expected only the imported stack, got %d stacks", n)
+	}
+	if !HasStack(pkgErr) {
+		t.Fatal("expected the pkg/errors stack to count")
+	}
+
+	SetImportPkgErrorsStacks(false)
+	stacks := WrapKeepingAllStacks(pkgErr).Stacks()
+	if len(stacks) != 1 {
+		t.Fatalf("expected only the new stack, got %d stacks", len(stacks))
+	}
+	if stacks[0][0].Function != "github.com/Invicton-Labs/go-stackerr.TestImportPkgErrorsStacks" {
+		t.Fatalf("expected the new stack, got %s", stacks[0][0].Function)
+	}
+	if HasStack(pkgErr) {
+		t.Fatal("expected the pkg/errors stack to be ignored")
+	}
+}
+
+func TestSettingsAreSafeForConcurrentUse(t *testing.T) {
+	defer func() {
+		SetCollapseParentStacks(true)
+		SetStackCaptureEnabled(true)
+		SetMaxWrapDepth(0)
+		SetMaxMessageBytes(0)
+		SetFunctionNameShortener(nil)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				SetCollapseParentStacks(j%2 == 0)
+				SetStackCaptureEnabled(j%3 != 0)
+				SetMaxWrapDepth(j % 5)
+				SetMaxMessageBytes(j % 7)
+				SetFunctionNameShortener(ShortFuncName)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				err := Wrap(fmt.Errorf("wrapped: %w", Wrap(errors.New("checksum mismatch"))))
+				_ = err.Error()
+				_ = err.FormatStacks()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStackCaptureDisabled(t *testing.T) {
+	defer SetStackCaptureEnabled(true)
+	SetStackCaptureEnabled(false)
+
+	base := errors.New("quota exceeded")
+	parentStack := StackTrace()
+	if parentStack != nil {
+		t.Fatal("expected no stack from StackTrace")
+	}
+	errs := map[string]Error{
+		"Wrap":        Wrap(base),
+		"Errorf":      Errorf("failed: %d", 1),
+		"WrapLabeled": WrapLabeled("handler", base),
+		"WrapFrom":    WrapFrom(TestStackCaptureDisabled, base),
+		"GoWrap":      GoWrap(parentStack, base),
+		"ReStack":     ReStack(Wrap(base)),
+		"WrapKV":      WrapKV(base, "key", "value"),
+	}
+	for name, err := range errs {
+		if n := len(err.Stacks()); n != 0 {
+			t.Fatalf("%s: expected no stacks, got %d", name, n)
+		}
+		if err.Error() == "" {
+			t.Fatalf("%s: expected the message to be kept", name)
+		}
+		_ = err.FormatStacks()
+		_ = err.Summary()
+		b, jerr := err.MarshalJSON()
+		if jerr != nil {
+			t.Fatalf("%s: %v", name, jerr)
+		}
+		if _, jerr := UnmarshalError(b); jerr != nil {
+			t.Fatalf("%s: %v", name, jerr)
+		}
+	}
+	if v, ok := errs["WrapKV"].Fields()["key"]; !ok || v != "value" {
+		t.Fatal("expected the fields to be kept")
+	}
+	// Explicitly given stacks are still used
+	if n := len(WrapWithStack(base, Stack{{Function: "f", File: "f.go", Line: 1}}).Stacks()); n != 1 {
+		t.Fatalf("expected the given stack, got %d stacks", n)
+	}
+}
+
+func TestFieldsWithoutFields(t *testing.T) {
+	err := Wrap(errors.New("broken pipe"))
+	fields := err.Fields()
+	if fields == nil || len(fields) != 0 {
+		t.Fatalf("expected an empty map, got %v", fields)
+	}
+	// The map of an error without fields isn't the error's own map
+	fields["key"] = "value"
+	if _, ok := err.Fields()["key"]; ok {
+		t.Fatal("expected the change to the returned map not to be kept")
+	}
+
+	err = err.WithSingle("key", "value")
+	if v := err.Fields()["key"]; v != "value" {
+		t.Fatalf("expected the field to be added, got %v", v)
+	}
+}
+
+func BenchmarkWrap(b *testing.B) {
+	base := errors.New("connection refused")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = Wrap(base)
+	}
+}
+
+func BenchmarkWrapWithFields(b *testing.B) {
+	base := Wrap(errors.New("record not found")).WithSingle("key", "value")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = Wrap(base)
+	}
+}
+
+// kindOfTest is a kind that is set on errors in tests
+type kindOfTest string
+
+// fastPathInputs are stack errors that wrapErrorWithSeverity takes the fast path for
+func fastPathInputs() map[string]*stackError {
+	defer SetCaptureStackTimestamps(false)
+	SetCaptureStackTimestamps(true)
+	base := errors.New("permission denied")
+	full := WithKind(WrapLabeled("handler", wrapInHelper(base)).
+		WithSingle("key", "value").
+		WithFieldVisibility("key", false).
+		WithAttachment("body", []byte("data")).
+		WithRelated(errors.New("related")).
+		WithSeverity(SeverityWarn), kindOfTest("kind"))
+	return map[string]*stackError{
+		"single":  Wrap(base).(*stackError),
+		"parents": WrapKeepingAllStacks(wrapInHelper(base)).(*stackError),
+		"full":    full.(*stackError),
+		"frozen":  Wrap(base).WithSingle("key", "value").Freeze().(*stackError),
+	}
+}
+
+func TestWrapFastPathMatchesSlowPath(t *testing.T) {
+	for name, serr := range fastPathInputs() {
+		for _, removeParents := range []bool{false, true} {
+			for _, severity := range []Severity{severityUnset, SeverityError} {
+				fast := rewrapStackError(serr, removeParents, severity)
+				slow := wrapErrorChain(serr, 0, false, removeParents, severity, nil)
+				if !reflect.DeepEqual(fast, slow) {
+					t.Fatalf("%s (removeParents=%v, severity=%v): expected %#v, got %#v", name, removeParents, severity, slow, fast)
+				}
+				if fast.FormatStacks() != slow.FormatStacks() || fast.Error() != slow.Error() {
+					t.Fatalf("%s: expected identical output", name)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkWrapWithoutExtraStack(b *testing.B) {
+	err := WrapKeepingAllStacks(wrapInHelper(errors.New("lock timeout"))).WithSingle("key", "value")
+	b.Run("fast", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = WrapWithoutExtraStack(err)
+		}
+	})
+	b.Run("slow", func(b *testing.B) {
+		serr := err.(*stackError)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = wrapErrorChain(serr, 0, false, collapseParentStacks.Load(), severityUnset, nil)
+		}
+	})
+}
+
+func TestCollapseSelfWraps(t *testing.T) {
+	err := recurse(3).WithAppendField("caller", "TestCollapseSelfWraps")
+	if n := len(err.Stacks()); n != 4 {
+		t.Fatalf("expected 4 stacks, got %d", n)
+	}
+	collapsed := err.CollapseSelfWraps()
+	if n := len(collapsed.Stacks()); n != 1 {
+		t.Fatalf("expected the stacks to be collapsed into 1, got %d", n)
+	}
+	callers := collapsed.Fields()["caller"]
+	if !reflect.DeepEqual(callers, []any{"recurse", "TestCollapseSelfWraps"}) {
+		t.Fatalf("expected the callers to be collapsed, got %v", callers)
+	}
+	// The original error isn't changed
+	if n := len(err.Fields()["caller"].([]any)); n != 5 {
+		t.Fatalf("expected the original error to keep 5 callers, got %d", n)
+	}
+}
+
+// recurse wraps an error at each level of a recursion, adding its name to the "caller" field
+func recurse(depth int) Error {
+	if depth == 0 {
+		return Wrap(errors.New("invalid input")).WithAppendField("caller", "recurse")
+	}
+	return WrapKeepingAllStacks(recurse(depth-1)).WithAppendField("caller", "recurse")
+}
+
+func TestJSONSchemaVersion(t *testing.T) {
+	b, err := json.Marshal(Wrap(errors.New("disk full")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := map[string]any{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["_v"] != float64(SchemaVersion) {
+		t.Fatalf("expected the schema version %d, got %v", SchemaVersion, raw["_v"])
+	}
+	if _, ok := raw["schema_version"]; ok {
+		t.Fatalf("expected only the _v version field, got %s", b)
+	}
+
+	payloads := map[string]string{
+		"v1": `{"_v":1,"err":"disk full","stack_traces":[[{"Function":"main.main","File":"main.go","Line":3}]],"meta_fields":{"key":"value"},"severity":"warn"}`,
+		"v0": `{"err":"disk full","stack_traces":[[{"Function":"main.main","File":"main.go","Line":3}]],"meta_fields":{"key":"value"}}`,
+	}
+	for name, payload := range payloads {
+		unmarshaled, err := UnmarshalError([]byte(payload))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if unmarshaled.Error() != "disk full" || unmarshaled.Fields()["key"] != "value" {
+			t.Fatalf("%s: unexpected error %q with fields %v", name, unmarshaled.Error(), unmarshaled.Fields())
+		}
+		if stacks := unmarshaled.Stacks(); len(stacks) != 1 || stacks[0][0].Function != "main.main" {
+			t.Fatalf("%s: unexpected stacks %v", name, stacks)
+		}
+	}
+
+	// The v0 form could marshal the wrapped error as an object
+	if unmarshaled, err := UnmarshalError([]byte(`{"err":{},"stack_traces":null,"meta_fields":null}`)); err != nil || unmarshaled.Error() != "" {
+		t.Fatalf("expected an empty message from a v0 payload, got %v", err)
+	}
+	if _, err := UnmarshalError([]byte(`{"_v":2,"err":"disk full"}`)); err == nil {
+		t.Fatal("expected a newer schema version to be rejected")
+	}
+}
+
+// wrapInHelper wraps an error in a function other than the caller
+func wrapInHelper(err error) Error {
+	return Wrap(err)
+}
+
+func TestForkFields(t *testing.T) {
+	base := WrapKeepingAllStacks(wrapInHelper(errors.New("upstream unavailable"))).WithSingle("shared", 1).(*stackError)
+	fork := base.ForkFields().(*stackError)
+
+	// The stacks are shared by reference
+	if len(fork.StackTraces) != 2 || &fork.StackTraces[0] != &base.StackTraces[0] {
+		t.Fatal("expected the stacks to be shared")
+	}
+	// But the fields aren't
+	fork.WithInPlace(map[string]any{"request": "a"})
+	fork.WithInPlace(map[string]any{"shared": 2})
+	if _, ok := base.Fields()["request"]; ok || base.Fields()["shared"] != 1 {
+		t.Fatalf("expected the base fields not to be changed, got %v", base.Fields())
+	}
+	if fork.Fields()["request"] != "a" || fork.Fields()["shared"] != 2 {
+		t.Fatalf("unexpected fork fields %v", fork.Fields())
+	}
+}
+
+// largeStackError is a stack error with many stacks
+func largeStackError() *stackError {
+	stacks := make(Stacks, 64)
+	for i := range stacks {
+		stacks[i] = Stack{{Function: fmt.Sprintf("pkg.f%d", i), File: "f.go", Line: i + 1}}
+	}
+	return WrapWithStacks(errors.New("token expired"), stacks).WithSingle("key", "value").(*stackError)
+}
+
+// benchmarkSink keeps the results of benchmarks, so they aren't optimized away
+var benchmarkSink any
+
+func BenchmarkForkFields(b *testing.B) {
+	se := largeStackError()
+	b.Run("ForkFields", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			benchmarkSink = se.forkFields()
+		}
+	})
+	b.Run("clone", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			benchmarkSink = se.clone()
+		}
+	})
+}
+
+func TestStackText(t *testing.T) {
+	err := Wrap(errors.New("bad gateway"))
+	fields := struct {
+		StackText *string `json:"stack_text"`
+	}{}
+	b, _ := json.Marshal(err)
+	if jerr := json.Unmarshal(b, &fields); jerr != nil || fields.StackText != nil {
+		t.Fatalf("expected no stack_text by default, got %s", b)
+	}
+
+	defer SetIncludeStackText(false)
+	SetIncludeStackText(true)
+	b, _ = json.Marshal(err)
+	if jerr := json.Unmarshal(b, &fields); jerr != nil || fields.StackText == nil {
+		t.Fatalf("expected stack_text, got %s", b)
+	}
+	if *fields.StackText != err.FormatStacks() {
+		t.Fatalf("expected stack_text to match FormatStacks, got %q", *fields.StackText)
+	}
+}
+
+func TestToECS(t *testing.T) {
+	err := Wrap(fs.ErrNotExist).WithSingle("path", "/tmp/x").WithSingle("attempt", 2)
+	ecs := err.ToECS()
+	expected := map[string]any{
+		"error.message":     err.Error(),
+		"error.type":        fmt.Sprintf("%T", fs.ErrNotExist),
+		"error.stack_trace": err.FormatStacks(),
+		"labels.path":       "/tmp/x",
+		"labels.attempt":    2,
+	}
+	if !reflect.DeepEqual(ecs, expected) {
+		t.Fatalf("expected %v, got %v", expected, ecs)
+	}
+}
+
+func TestUnmarshalFutureSchemaVersion(t *testing.T) {
+	payload := fmt.Sprintf(`{"_v":%d,"err":"no such host","stack_traces":[],"meta_fields":{}}`, SchemaVersion+1)
+	_, err := UnmarshalError([]byte(payload))
+	if err == nil {
+		t.Fatal("expected a future schema version to be rejected")
+	}
+	if !strings.Contains(err.Error(), "unsupported schema version") {
+		t.Fatalf("expected a descriptive error, got %q", err)
+	}
+}
+
+// recoverInHelper converts a recovered panic value from within a helper function
+func recoverInHelper(r any) Error {
+	return FromRecoverSkip(r, 1)
+}
+
+// panicAndRecover panics, and recovers through a helper function
+func panicAndRecover() (err Error) {
+	defer func() {
+		err = recoverInHelper(recover())
+	}()
+	panic("boom")
+}
+
+// panicAndRecoverDirectly panics, and recovers directly in the deferred function
+func panicAndRecoverDirectly() (err Error) {
+	defer func() {
+		err = FromRecover(recover())
+	}()
+	panic(fs.ErrNotExist)
+}
+
+func TestFromRecover(t *testing.T) {
+	for name, err := range map[string]Error{
+		"panicAndRecover":         panicAndRecover(),
+		"panicAndRecoverDirectly": panicAndRecoverDirectly(),
+	} {
+		top, ok := err.Stacks()[0].trimStack().Top()
+		if !ok || top.Function != packageFunctionPrefix+name {
+			t.Fatalf("%s: expected the panicking function to be the top frame, got %v", name, err.Stacks()[0])
+		}
+	}
+}
+
+func TestTranslateTo(t *testing.T) {
+	errNoRows := errors.New("no rows")
+	errUserNotFound := errors.New("user not found")
+	original := Wrap(errNoRows).WithSingle("user", "alice")
+
+	for _, keepInChain := range []bool{false, true} {
+		translated := original.TranslateTo(errUserNotFound, keepInChain)
+		if translated.Error() != "user not found" {
+			t.Fatalf("keepInChain=%v: unexpected message %q", keepInChain, translated.Error())
+		}
+		if !errors.Is(translated, errUserNotFound) {
+			t.Fatalf("keepInChain=%v: expected the new error to be in the chain", keepInChain)
+		}
+		if errors.Is(translated, errNoRows) != keepInChain {
+			t.Fatalf("keepInChain=%v: unexpected errors.Is result for the original error", keepInChain)
+		}
+		if !translated.Stacks().Equal(original.Stacks()) || translated.Fields()["user"] != "alice" {
+			t.Fatalf("keepInChain=%v: expected the stacks and fields to be kept", keepInChain)
+		}
+	}
+	if original.Error() != "no rows" {
+		t.Fatal("expected the original error not to be changed")
+	}
+}
+
+func TestWrapf(t *testing.T) {
+	if Wrapf(nil, "failed %d", 1) != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+	base := errors.New("rate limited")
+	err := Wrapf(base, "failed after %d attempts", 3)
+	if err.Error() != "failed after 3 attempts: rate limited" {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+	if !errors.Is(err, base) || errors.Unwrap(err.Unwrap()) != base {
+		t.Fatal("expected the original error to be in the chain")
+	}
+	if top, ok := err.Stacks()[0].Top(); len(err.Stacks()) != 1 || !ok || top.Function != packageFunctionPrefix+"TestWrapf" {
+		t.Fatalf("expected a stack from the caller, got %v", err.Stacks())
+	}
+
+	// The caller's arguments aren't overwritten
+	args := make([]any, 1, 2)
+	args[0] = 3
+	Wrapf(base, "failed after %d attempts", args...)
+	if extra := args[:2][1]; extra != nil {
+		t.Fatalf("expected the caller's array not to be changed, got %v", extra)
+	}
+}
+
+func TestWithIf(t *testing.T) {
+	err := Wrap(errors.New("checksum mismatch"))
+	if unchanged := err.WithIf(false, map[string]any{"table": "users"}); unchanged != err {
+		t.Fatal("expected the same error when the condition is false")
+	}
+	if _, ok := err.Fields()["table"]; ok {
+		t.Fatal("expected no field when the condition is false")
+	}
+	enriched := err.WithIf(true, map[string]any{"table": "users"})
+	if enriched == err || enriched.Fields()["table"] != "users" {
+		t.Fatalf("expected a copy with the field, got %v", enriched.Fields())
+	}
+}
+
+// panicValue is a custom panic value
+type panicValue struct {
+	Code   int
+	Detail string
+}
+
+// recoverValue panics with a value, and recovers it
+func recoverValue(v any) (err Error) {
+	defer func() {
+		err = FromRecover(recover())
+	}()
+	panic(v)
+}
+
+func TestPanicValue(t *testing.T) {
+	for _, v := range []any{"boom", 42, panicValue{Code: 7, Detail: "bad state"}} {
+		err := recoverValue(v)
+		recovered, ok := err.PanicValue()
+		if !ok || !reflect.DeepEqual(recovered, v) {
+			t.Fatalf("expected the panic value %#v, got %#v", v, recovered)
+		}
+		if err.Error() != fmt.Sprintf("%v", v) {
+			t.Fatalf("unexpected message %q", err.Error())
+		}
+	}
+	if _, ok := Wrap(errors.New("quota exceeded")).PanicValue(); ok {
+		t.Fatal("expected no panic value")
+	}
+
+	// Only the string form is in the fields, so any value can be marshaled
+	ch := make(chan int)
+	err := recoverValue(ch)
+	if recovered, _ := Wrap(err).PanicValue(); recovered != ch {
+		t.Fatalf("expected the channel to be kept when wrapping, got %v", recovered)
+	}
+	if v := Wrap(err).Fields()[PanicValueField]; v != err.Error() {
+		t.Fatalf("expected the string form in the fields, got %v", v)
+	}
+	b, merr := json.Marshal(err)
+	if merr != nil {
+		t.Fatal(merr)
+	}
+	unmarshaled, uerr := UnmarshalError(b)
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	if recovered, ok := unmarshaled.PanicValue(); !ok || recovered != err.Error() {
+		t.Fatalf("expected the string form after unmarshaling, got %v", recovered)
+	}
+}
+
+func TestReconstruct(t *testing.T) {
+	stacks := Stacks{
+		{{Function: "main.handle", File: "main.go", Line: 8}, {Function: "main.main", File: "main.go", Line: 3}},
+		{{Function: "pkg.query", File: "db.go", Line: 21}},
+	}
+	fields := map[string]any{"user": "alice"}
+	err := Reconstruct("query failed", stacks, fields)
+	if err.Error() != "query failed" {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+	if !reflect.DeepEqual(err.Stacks(), stacks) || !reflect.DeepEqual(err.Fields(), fields) {
+		t.Fatalf("unexpected stacks %v or fields %v", err.Stacks(), err.Fields())
+	}
+	// The fields are copied
+	fields["user"] = "bob"
+	if err.Fields()["user"] != "alice" {
+		t.Fatal("expected the fields to be copied")
+	}
+	if formatted := err.FormatStacks(); formatted != stacks.Format() || !strings.Contains(formatted, "main.handle\n\tmain.go:8") {
+		t.Fatalf("unexpected formatted stacks %q", formatted)
+	}
+}
+
+func TestCollapseParentStacks(t *testing.T) {
+	inner := wrapInHelper(errors.New("broken pipe"))
+	// The outer stack is a parent of the inner stack, so it's collapsed by default
+	if n := len(Wrap(inner).Stacks()); n != 1 {
+		t.Fatalf("expected 1 stack with collapsing on, got %d", n)
+	}
+	if n := len(WrapKeepingAllStacks(inner).Stacks()); n != 2 {
+		t.Fatalf("expected 2 stacks when keeping all stacks, got %d", n)
+	}
+
+	defer SetCollapseParentStacks(true)
+	SetCollapseParentStacks(false)
+	stacks := Wrap(inner).Stacks()
+	if len(stacks) != 2 || !stacks[1].Equal(inner.Stacks()[0]) {
+		t.Fatalf("expected the new and inner stacks with collapsing off, got %v", stacks)
+	}
+}
+
+func TestInvolvedFunctions(t *testing.T) {
+	err := WrapWithStacks(errors.New("connection refused"), Stacks{
+		{
+			{Function: "main.handle", File: "main.go", Line: 8},
+			{Function: "runtime.gopanic", File: "panic.go", Line: 770},
+			{Function: "main.main", File: "main.go", Line: 3},
+			{Function: "runtime.main", File: "proc.go", Line: 250},
+		},
+		{
+			{Function: "pkg.query", File: "db.go", Line: 21},
+			{Function: "main.handle", File: "main.go", Line: 7},
+			{Function: "main.main", File: "main.go", Line: 3},
+		},
+	})
+	expected := []string{"main.handle", "main.main", "pkg.query"}
+	if functions := err.InvolvedFunctions(); !reflect.DeepEqual(functions, expected) {
+		t.Fatalf("expected %v, got %v", expected, functions)
+	}
+	if functions := Reconstruct("connection refused", nil, nil).InvolvedFunctions(); functions == nil || len(functions) != 0 {
+		t.Fatalf("expected no functions, got %v", functions)
+	}
+}
+
+func TestWrapWithStacks(t *testing.T) {
+	parsed := ParseStacks("main.handle\n\tmain.go:8\nmain.main\n\tmain.go:3\n\npkg.query\n\tdb.go:21")
+	if len(parsed) != 2 {
+		t.Fatalf("expected 2 parsed stacks, got %d", len(parsed))
+	}
+	// Duplicates and parents are removed, and the order is kept
+	parent := Stack{{Function: "main.main", File: "main.go", Line: 5}}
+	err := WrapWithStacks(errors.New("record not found"), Stacks{parent, parsed[0], parsed[1], parsed[1]})
+	if !err.Stacks().Equal(parsed) {
+		t.Fatalf("expected the parsed stacks in order, got %v", err.Stacks())
+	}
+	if top, _ := WrapWithStacks(errors.New("record not found"), nil).Stacks()[0].Top(); top.Function != packageFunctionPrefix+"TestWrapWithStacks" {
+		t.Fatalf("expected the caller's stack without given stacks, got %v", top)
+	}
+}
+
+func TestMaxFieldValueBytes(t *testing.T) {
+	body := strings.Repeat("x", 2048)
+	err := Wrap(errors.New("permission denied")).With(map[string]any{
+		"body":  body,
+		"ids":   []int{1000, 2000, 3000, 4000},
+		"short": "ok",
+	})
+	defer SetMaxFieldValueBytes(0)
+	SetMaxFieldValueBytes(10)
+
+	b, jerr := json.Marshal(err)
+	if jerr != nil {
+		t.Fatal(jerr)
+	}
+	fields := struct {
+		MetaFields map[string]any `json:"meta_fields"`
+	}{}
+	if jerr := json.Unmarshal(b, &fields); jerr != nil {
+		t.Fatal(jerr)
+	}
+	expected := map[string]any{
+		"body":  strings.Repeat("x", 10) + "...(truncated)",
+		"ids":   "[1000,2000...(truncated)",
+		"short": "ok",
+	}
+	if !reflect.DeepEqual(fields.MetaFields, expected) {
+		t.Fatalf("expected %v, got %v", expected, fields.MetaFields)
+	}
+	// The stored values aren't changed
+	if err.Fields()["body"] != body || len(err.Fields()["ids"].([]int)) != 4 {
+		t.Fatal("expected the stored fields not to be truncated")
+	}
+}
+
+// failHelper wraps an error, attributing it to the caller of this helper
+func failHelper(err error) Error {
+	return WrapFrom(failHelper, err)
+}
+
+// callFailHelper calls failHelper from another function
+func callFailHelper(err error) Error {
+	return failHelper(err)
+}
+
+func TestWrapFrom(t *testing.T) {
+	base := errors.New("lock timeout")
+	for _, test := range []struct {
+		err Error
+		top string
+	}{
+		{failHelper(base), "TestWrapFrom"},
+		{callFailHelper(base), "callFailHelper"},
+		// A marker that isn't in the stack is ignored
+		{WrapFrom(callFailHelper, base), "TestWrapFrom"},
+	} {
+		if top, ok := test.err.Stacks()[0].Top(); !ok || top.Function != packageFunctionPrefix+test.top {
+			t.Fatalf("expected %s to be the top frame, got %v", test.top, test.err.Stacks()[0])
+		}
+	}
+	if WrapFrom(failHelper, nil) != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+}
+
+func TestFormatFull(t *testing.T) {
+	err := Wrap(errors.New("invalid input")).With(map[string]any{"zeta": 1, "alpha": "a", "mid": true})
+	expected := "invalid input\nFields:\n  alpha: a\n  mid: true\n  zeta: 1\n" + err.FormatStacks()
+	if formatted := err.FormatFull(); formatted != expected {
+		t.Fatalf("expected %q, got %q", expected, formatted)
+	}
+	noFields := Wrap(errors.New("invalid input"))
+	if formatted := noFields.FormatFull(); formatted != "invalid input\n"+noFields.FormatStacks() {
+		t.Fatalf("expected no fields section, got %q", formatted)
+	}
+}
+
+func TestWithoutStacks(t *testing.T) {
+	err := Wrap(errors.New("disk full")).WithSingle("user", "alice")
+	stripped := err.WithoutStacks()
+	if stacks := stripped.Stacks(); stacks == nil || len(stacks) != 0 {
+		t.Fatalf("expected no stacks, got %v", stacks)
+	}
+	if stripped.Error() != "disk full" || stripped.Fields()["user"] != "alice" {
+		t.Fatal("expected the message and fields to be kept")
+	}
+	if len(err.Stacks()) != 1 {
+		t.Fatal("expected the original error to keep its stacks")
+	}
+	if formatted := stripped.FormatStacks(); formatted != stackDivider+"\n" {
+		t.Fatalf("expected only the divider, got %q", formatted)
+	}
+	_ = stripped.FormatFull()
+	_ = stripped.Summary()
+	if _, jerr := json.Marshal(stripped); jerr != nil {
+		t.Fatal(jerr)
+	}
+}
+
+func TestWrapWithStackFromError(t *testing.T) {
+	source := wrapInHelper(errors.New("sql: no rows"))
+	errUserNotFound := errors.New("user not found")
+	err := WrapWithStackFromError(errUserNotFound, source)
+	if !err.Stacks().Equal(source.Stacks()) {
+		t.Fatalf("expected the source's stacks, got %v", err.Stacks())
+	}
+	if err.Error() != "user not found" || !errors.Is(err, errUserNotFound) || errors.Is(err, source) {
+		t.Fatal("expected only the new error to be in the chain")
+	}
+
+	// The stacks of a "github.com/pkg/errors" error are used too
+	pkgErr := nativeStackErrors.New("pkg")
+	if stacks := WrapWithStackFromError(errUserNotFound, pkgErr).Stacks(); len(stacks) != 1 || !stacks[0].Equal(stackTracerStack(pkgErr.(stackTracer))) {
+		t.Fatalf("expected the pkg/errors stack, got %v", stacks)
+	}
+	// Without source stacks, the caller's stack is used
+	if top, _ := WrapWithStackFromError(errUserNotFound, errors.New("plain")).Stacks()[0].Top(); top.Function != packageFunctionPrefix+"TestWrapWithStackFromError" {
+		t.Fatalf("expected the caller's stack, got %v", top)
+	}
+}
+
+func TestFieldVisibility(t *testing.T) {
+	err := Wrap(errors.New("upstream unavailable")).
+		WithSingle("internal", "secret").
+		WithSingle("public", "value").
+		WithFieldVisibility("internal", false)
+	b, jerr := err.MarshalJSON()
+	if jerr != nil {
+		t.Fatal(jerr)
+	}
+	if strings.Contains(string(b), "internal") || !strings.Contains(string(b), "public") {
+		t.Fatalf("expected only the public field in the JSON, got %s", b)
+	}
+	if fields := err.Fields(); fields["internal"] != "secret" || fields["public"] != "value" {
+		t.Fatalf("expected both fields, got %v", fields)
+	}
+
+	// Making the field public again includes it in the JSON
+	b, jerr = err.WithFieldVisibility("internal", true).MarshalJSON()
+	if jerr != nil {
+		t.Fatal(jerr)
+	}
+	if !strings.Contains(string(b), "internal") {
+		t.Fatalf("expected the field in the JSON, got %s", b)
+	}
+}
+
+func TestRelated(t *testing.T) {
+	base := errors.New("token expired")
+	rollback, cleanup := errors.New("rollback failed"), Wrap(errors.New("cleanup failed"))
+	err := Wrap(base).WithRelated(rollback).WithRelated(cleanup)
+	if related := err.Related(); len(related) != 2 || related[0] != rollback || related[1] != cleanup {
+		t.Fatalf("expected the related errors in order, got %v", related)
+	}
+	// Related errors aren't in the unwrap chain
+	if errors.Is(err, rollback) || errors.Is(err, cleanup) || !errors.Is(err, base) {
+		t.Fatal("expected only the wrapped error in the chain")
+	}
+
+	b, jerr := err.MarshalJSON()
+	if jerr != nil {
+		t.Fatal(jerr)
+	}
+	if !strings.Contains(string(b), "rollback failed") || !strings.Contains(string(b), "cleanup failed") {
+		t.Fatalf("expected the related errors in the JSON, got %s", b)
+	}
+	unmarshaled := &stackError{}
+	if jerr := json.Unmarshal(b, unmarshaled); jerr != nil {
+		t.Fatal(jerr)
+	}
+	if related := unmarshaled.Related(); len(related) != 2 || related[0].Error() != "rollback failed" {
+		t.Fatalf("expected the related errors to be unmarshaled, got %v", related)
+	}
+}
+
+func TestFormatStacksDedup(t *testing.T) {
+	stack := StackTrace()
+	// Set the stacks directly, since wrapping removes duplicates
+	err := Wrap(errors.New("bad gateway")).(*stackError)
+	err.SetStacks(Stacks{stack, append(Stack{}, stack...), otherStack})
+	expected := Stacks{stack, otherStack}.Format()
+	if formatted := err.FormatStacksDedup(); formatted != expected {
+		t.Fatalf("expected %q, got %q", expected, formatted)
+	}
+	if formatted := err.FormatStacks(); strings.Count(formatted, stack[0].Function) != 2 {
+		t.Fatalf("expected FormatStacks to include the duplicate, got %q", formatted)
+	}
+}
+
+func TestAsStackErr(t *testing.T) {
+	if serr, ok := AsStackErr(nil); ok || serr != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+
+	existing := Wrap(errors.New("no such host"))
+	serr, ok := AsStackErr(existing)
+	if !ok || serr != existing {
+		t.Fatal("expected the existing stackerr.Error to be returned as-is")
+	}
+	serr.WithInPlace(map[string]any{"key": "value"})
+	if existing.Fields()["key"] != "value" {
+		t.Fatal("expected the existing error to be edited in place")
+	}
+
+	base := errors.New("no such host")
+	serr, ok = AsStackErr(base)
+	if !ok || !errors.Is(serr, base) || len(serr.Stacks()) != 1 {
+		t.Fatal("expected the plain error to be wrapped with a stack")
+	}
+	if top, _ := serr.Stacks()[0].Top(); top.Function != packageFunctionPrefix+"TestAsStackErr" {
+		t.Fatalf("expected a stack from the caller, got %v", top)
+	}
+}
+
+// The stackerr.Error interface cooperates with the errors package
+var (
+	_ interface{ Is(error) bool } = (*stackError)(nil)
+	_ interface{ As(any) bool }   = (*stackError)(nil)
+	_ interface{ Unwrap() error } = Error(nil)
+)
+
+func TestIsAndAs(t *testing.T) {
+	base := &fs.PathError{Op: "open", Path: "config.json", Err: fs.ErrNotExist}
+	var err Error = Wrap(base)
+	if !err.Is(base) {
+		t.Fatal("expected the wrapped error to match")
+	}
+	if err.Is(fs.ErrPermission) {
+		t.Fatal("expected an unrelated error not to match")
+	}
+	var pathErr *fs.PathError
+	if !err.As(&pathErr) || pathErr != base {
+		t.Fatalf("expected the path error, got %v", pathErr)
+	}
+	var serr Error
+	if err.As(&serr) {
+		t.Fatal("expected the stackerr.Error itself not to be in its wrapped chain")
+	}
+
+	// Only the wrapped error itself is checked, and errors.Is and errors.As follow the chain
+	err = Wrap(fmt.Errorf("load config: %w", base))
+	if err.Is(base) || err.As(&pathErr) {
+		t.Fatal("expected the rest of the chain not to be checked")
+	}
+	if !errors.Is(err, base) || !errors.Is(err, fs.ErrNotExist) || !errors.As(err, &pathErr) {
+		t.Fatal("expected the errors package to find the errors in the chain")
+	}
+}
+
+func TestIsDeepChain(t *testing.T) {
+	var err error = errors.New("root")
+	for i := 0; i < 200; i++ {
+		err = Wrap(fmt.Errorf("layer %d: %w", i, err))
+	}
+	done := make(chan bool)
+	go func() {
+		var pathErr *fs.PathError
+		done <- errors.Is(err, fs.ErrNotExist) || errors.As(err, &pathErr)
+	}()
+	select {
+	case found := <-done:
+		if found {
+			t.Fatal("expected no match in the chain")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected errors.Is and errors.As to be linear in the depth of the chain")
+	}
+}
+
+func TestWrapOnce(t *testing.T) {
+	if WrapOnce(nil) != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+	var err error = errors.New("rate limited")
+	var wrapped Error
+	// Wrapping again at the same line (e.g. in a retry loop) doesn't add a stack
+	for i := 0; i < 3; i++ {
+		wrapped = WrapOnce(err)
+		err = wrapped
+	}
+	if n := len(wrapped.Stacks()); n != 1 {
+		t.Fatalf("expected 1 stack, got %d", n)
+	}
+	original, _ := wrapped.Stacks()[0].Top()
+	defer SetCollapseParentStacks(true)
+	SetCollapseParentStacks(false)
+	rewrapped := WrapOnce(wrapped)
+	if n := len(rewrapped.Stacks()); n != 2 {
+		t.Fatalf("expected a stack to be added at a different line, got %d stacks", n)
+	}
+	if top, _ := rewrapped.Stacks()[0].Top(); top.Line == original.Line {
+		t.Fatalf("expected the new stack to be from a different line, got %v", top)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	err := WrapWithStack(errors.New("connection\nrefused"), Stack{
+		{Function: "github.com/x/service.(*Client).Connect", File: "/src/service/dial.go", Line: 42},
+	})
+	if summary := err.Summary(); summary != "connection refused (service.(*Client).Connect at dial.go:42)" {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+	if summary := Wrap(errors.New("checksum mismatch")).WithoutStacks().Summary(); summary != "checksum mismatch" {
+		t.Fatalf("expected only the message without a stack, got %q", summary)
+	}
+}
+
+func TestWrapKV(t *testing.T) {
+	base := errors.New("quota exceeded")
+	if WrapKV(nil, "user", 1) != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+	err := WrapKV(base, "user", 42, "op", "delete")
+	if fields := err.Fields(); len(fields) != 2 || fields["user"] != 42 || fields["op"] != "delete" {
+		t.Fatalf("expected the pairs as fields, got %v", fields)
+	}
+	if !errors.Is(err, base) || len(err.Stacks()) != 1 {
+		t.Fatal("expected the error to be wrapped with a stack")
+	}
+
+	// A final key without a value is a bad key-value pair
+	if fields := WrapKV(base, "user", 42, "op").Fields(); len(fields) != 2 || fields[BadKVField] != "op" {
+		t.Fatalf("expected the dangling key as a bad pair, got %v", fields)
+	}
+	// A key that isn't a string is a bad key-value pair, and the following pairs are still used
+	if fields := WrapKV(base, 7, "op", "delete").Fields(); len(fields) != 2 || fields[BadKVField] != 7 || fields["op"] != "delete" {
+		t.Fatalf("expected the non-string key as a bad pair, got %v", fields)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	frozen := Wrap(errors.New("broken pipe")).WithSingle("key", "value").Freeze().(*stackError)
+	stacks := frozen.Stacks()
+	frozen.WithInPlace(map[string]any{"key": "changed"})
+	frozen.SetError(errors.New("changed"))
+	frozen.SetStacks(Stacks{otherStack})
+	if frozen.Fields()["key"] != "value" || frozen.Error() != "broken pipe" || !frozen.Stacks().Equal(stacks) {
+		t.Fatal("expected the in-place edits not to change a frozen error")
+	}
+
+	// Copies can still be made, and they aren't frozen
+	clone := frozen.WithSingle("key", "changed").(*stackError)
+	if clone.Fields()["key"] != "changed" || frozen.Fields()["key"] != "value" {
+		t.Fatal("expected only the copy to be changed")
+	}
+	clone.WithInPlace(map[string]any{"other": true})
+	if clone.Fields()["other"] != true {
+		t.Fatal("expected the copy to be editable in place")
+	}
+	// Wrapping makes a copy too, which isn't frozen
+	if Wrap(frozen).(*stackError).Frozen {
+		t.Fatal("expected the wrapped error not to be frozen")
+	}
+}
+
+func TestPanicOnFrozenEdit(t *testing.T) {
+	defer SetPanicOnFrozenEdit(false)
+	SetPanicOnFrozenEdit(true)
+	frozen := Wrap(errors.New("connection refused")).Freeze().(*stackError)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected an in-place edit of a frozen error to panic")
+		}
+	}()
+	frozen.WithInPlace(map[string]any{"key": "value"})
+}
+
+func TestAttachments(t *testing.T) {
+	blob := []byte("request snapshot")
+	original := Wrap(errors.New("record not found"))
+	err := original.WithAttachment("request", blob)
+	if data, ok := err.Attachment("request"); !ok || string(data) != string(blob) {
+		t.Fatalf("expected the attachment, got %q", data)
+	}
+	if _, ok := original.Attachment("request"); ok {
+		t.Fatal("expected the original error not to have the attachment")
+	}
+	if _, ok := err.Attachment("missing"); ok {
+		t.Fatal("expected no attachment for an unknown name")
+	}
+	if len(err.Fields()) != 0 || strings.Contains(err.FormatFull(), "request snapshot") {
+		t.Fatal("expected the attachment not to be a field or formatted")
+	}
+
+	b, jerr := err.MarshalJSON()
+	if jerr != nil {
+		t.Fatal(jerr)
+	}
+	if strings.Contains(string(b), "attachments") {
+		t.Fatalf("expected the default JSON to omit the attachment, got %s", b)
+	}
+	b, jerr = err.MarshalWithAttachments()
+	if jerr != nil {
+		t.Fatal(jerr)
+	}
+	// Byte slices are base64-encoded
+	if !strings.Contains(string(b), `"attachments":{"request":"cmVxdWVzdCBzbmFwc2hvdA=="}`) {
+		t.Fatalf("expected the base64-encoded attachment, got %s", b)
+	}
+	unmarshaled := &stackError{}
+	if jerr := json.Unmarshal(b, unmarshaled); jerr != nil {
+		t.Fatal(jerr)
+	}
+	if data, ok := unmarshaled.Attachment("request"); !ok || string(data) != string(blob) {
+		t.Fatalf("expected the attachment to be unmarshaled, got %q", data)
+	}
+}
+
+func TestCollapsedStackCount(t *testing.T) {
+	inner := wrapInHelper(errors.New("permission denied"))
+	if n := inner.CollapsedStackCount(); n != 0 {
+		t.Fatalf("expected no collapsed stacks, got %d", n)
+	}
+	collapsed := Wrap(Wrap(inner))
+	kept := WrapKeepingAllStacks(WrapKeepingAllStacks(inner))
+	n := collapsed.CollapsedStackCount()
+	if n == 0 || n != len(kept.Stacks())-len(collapsed.Stacks()) {
+		t.Fatalf("expected the collapsed count to match the removed stacks, got %d", n)
+	}
+	if kept.CollapsedStackCount() != 0 {
+		t.Fatal("expected no collapsed stacks when keeping all stacks")
+	}
+
+	b, jerr := collapsed.MarshalJSON()
+	if jerr != nil {
+		t.Fatal(jerr)
+	}
+	if !strings.Contains(string(b), fmt.Sprintf(`"collapsed_stacks":%d`, n)) {
+		t.Fatalf("expected the collapsed count in the JSON, got %s", b)
+	}
+}
+
+func TestReStack(t *testing.T) {
+	if ReStack(nil) != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+	base := errors.New("lock timeout")
+	original := WrapKeepingAllStacks(wrapInHelper(base)).WithSingle("key", "value")
+	restacked := ReStack(original)
+	if len(original.Stacks()) != 2 {
+		t.Fatal("expected the original error to keep its stacks")
+	}
+	stacks := restacked.Stacks()
+	if len(stacks) != 1 {
+		t.Fatalf("expected 1 stack, got %d", len(stacks))
+	}
+	if top, _ := stacks[0].Top(); top.Function != packageFunctionPrefix+"TestReStack" {
+		t.Fatalf("expected a stack from the caller, got %v", top)
+	}
+	if restacked.Fields()["key"] != "value" || restacked.Error() != "lock timeout" || !errors.Is(restacked, base) {
+		t.Fatal("expected the message and fields to be kept")
+	}
+	// Stacks of errors further down the chain are replaced too
+	if n := len(ReStack(fmt.Errorf("outer: %w", original)).Stacks()); n != 1 {
+		t.Fatalf("expected 1 stack, got %d", n)
+	}
+}
+
+func TestSortedFields(t *testing.T) {
+	err := Wrap(errors.New("invalid input")).With(map[string]any{"b": 2, "c": 3, "a": 1})
+	fields := err.SortedFields()
+	expected := []Field{{"a", 1}, {"b", 2}, {"c", 3}}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected %v, got %v", expected, fields)
+	}
+	// The slice is a copy
+	fields[0].Value = "changed"
+	if err.Fields()["a"] != 1 {
+		t.Fatal("expected the error's fields not to be changed")
+	}
+	if fields := Wrap(errors.New("invalid input")).SortedFields(); len(fields) != 0 {
+		t.Fatalf("expected no fields, got %v", fields)
+	}
+}
+
+func TestGoWrap(t *testing.T) {
+	base := errors.New("disk full")
+	parentStack := StackTrace()
+	errs := make(chan Error)
+	go func() {
+		errs <- GoWrap(parentStack, base)
+	}()
+	err := <-errs
+
+	stacks := err.Stacks()
+	if len(stacks) != 2 {
+		t.Fatalf("expected the worker and parent stacks, got %d", len(stacks))
+	}
+	if top, _ := stacks[0].Top(); top.Function != packageFunctionPrefix+"TestGoWrap.func1" {
+		t.Fatalf("expected the worker's stack first, got %v", top)
+	}
+	if !stacks[1].Equal(parentStack) {
+		t.Fatalf("expected the parent stack as the oldest stack, got %v", stacks[1])
+	}
+	if !errors.Is(err, base) {
+		t.Fatal("expected the wrapped error to be in the chain")
+	}
+	if GoWrap(parentStack, nil) != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	statement := "query failed: SELECT " + strings.Repeat("column, ", 1000) + "id FROM users"
+	err := Wrap(errors.New(statement))
+	defer SetMaxMessageBytes(0)
+	SetMaxMessageBytes(20)
+	if msg := err.Error(); msg != "query failed: SELECT...(truncated)" {
+		t.Fatalf("expected the message to be truncated, got %q", msg)
+	}
+	if err.Unwrap().Error() != statement {
+		t.Fatal("expected the full message from the wrapped error")
+	}
+	if msg := Wrap(errors.New("short")).Error(); msg != "short" {
+		t.Fatalf("expected a short message not to be truncated, got %q", msg)
+	}
+	// Multi-byte characters aren't split
+	if msg := Wrap(errors.New(strings.Repeat("é", 20))).Error(); msg != strings.Repeat("é", 10)+"...(truncated)" {
+		t.Fatalf("expected whole characters, got %q", msg)
+	}
+}
+
+// returnFromHelper returns an error from a single return site
+func returnFromHelper(err error) error {
+	return Return(err)
+}
+
+func TestReturn(t *testing.T) {
+	base := errors.New("upstream unavailable")
+	fresh := returnFromHelper(base).(Error)
+	if n := len(fresh.Stacks()); n != 1 {
+		t.Fatalf("expected a stack for a fresh error, got %d", n)
+	}
+	// Returning the error again from the same line doesn't add a stack
+	again := returnFromHelper(fresh)
+	if again != fresh {
+		t.Fatal("expected the already-wrapped error to be returned unchanged")
+	}
+	if Return(nil) != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+}
+
+func TestWithAppendField(t *testing.T) {
+	inner := Wrap(errors.New("token expired")).WithAppendField("attempt", 1)
+	outer := Wrap(fmt.Errorf("retry: %w", inner)).WithAppendField("attempt", 2)
+	if values := outer.Fields()["attempt"]; !reflect.DeepEqual(values, []any{1, 2}) {
+		t.Fatalf("expected the value from each layer in order, got %v", values)
+	}
+	if values := inner.Fields()["attempt"]; !reflect.DeepEqual(values, []any{1}) {
+		t.Fatalf("expected the inner error not to be changed, got %v", values)
+	}
+
+	// An existing value that isn't a list becomes the first value
+	err := Wrap(errors.New("token expired")).WithSingle("attempt", 0).WithAppendField("attempt", 1)
+	if values := err.Fields()["attempt"]; !reflect.DeepEqual(values, []any{0, 1}) {
+		t.Fatalf("expected the existing value first, got %v", values)
+	}
+	// Overwriting the field replaces the whole list
+	if value := outer.WithSingle("attempt", 3).Fields()["attempt"]; value != 3 {
+		t.Fatalf("expected the list to be replaced, got %v", value)
+	}
+}
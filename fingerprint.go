@@ -0,0 +1,51 @@
+package stackerr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// Fingerprint gets a stable identifier for an error, for grouping occurrences of the
+// same error. It's derived from the type of the error's root cause and the frames of
+// its stacks (see Stack.Equal), but not from its message or fields, which often
+// contain values that vary between occurrences. Errors without any stacks are
+// fingerprinted by the type of their root cause alone. A nil error has an empty fingerprint.
+func Fingerprint(err error) string {
+	if err == nil {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%T\n", rootCause(err))
+	for _, stack := range chainStacks(err) {
+		for _, frame := range stack.trimStack() {
+			h.Write([]byte(frame.Function + "\n" + frame.File + ":" + strconv.Itoa(frame.Line) + "\n"))
+		}
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// The function that is called with the fingerprint of each new error
+var occurrenceCounter atomic.Pointer[func(fingerprint string)]
+
+// SetOccurrenceCounter sets a function that is called with the Fingerprint of every
+// stackerr.Error that is created (e.g. by Wrap, Errorf, or FromRecover), e.g. to
+// count occurrences of each error for error budgets. A nil function (the default)
+// disables it.
+func SetOccurrenceCounter(counter func(fingerprint string)) {
+	if counter == nil {
+		occurrenceCounter.Store(nil)
+		return
+	}
+	occurrenceCounter.Store(&counter)
+}
+
+// countOccurrence calls the occurrence counter, if there is one, for a new error.
+func countOccurrence(err Error) {
+	if counter := occurrenceCounter.Load(); counter != nil {
+		(*counter)(Fingerprint(err))
+	}
+}
@@ -0,0 +1,48 @@
+package stackerr
+
+import (
+	"errors"
+	"testing"
+)
+
+// newQueryError creates the same error every time it's called
+func newQueryError() Error {
+	return Wrap(errors.New("query failed"))
+}
+
+func TestFingerprint(t *testing.T) {
+	if Fingerprint(nil) != "" {
+		t.Fatal("expected an empty fingerprint for a nil error")
+	}
+	first, second := newQueryError(), newQueryError().WithSingle("user", "alice")
+	if Fingerprint(first) != Fingerprint(second) {
+		t.Fatal("expected the same fingerprint for the same error, regardless of its fields")
+	}
+	if Fingerprint(first) == Fingerprint(Wrap(errors.New("query failed"))) {
+		t.Fatal("expected a different fingerprint for an error from a different place")
+	}
+}
+
+func TestSetOccurrenceCounter(t *testing.T) {
+	defer SetOccurrenceCounter(nil)
+	// No counter is set by default
+	newQueryError()
+
+	counts := map[string]int{}
+	SetOccurrenceCounter(func(fingerprint string) {
+		counts[fingerprint]++
+	})
+	var fingerprint string
+	for i := 0; i < 3; i++ {
+		fingerprint = Fingerprint(newQueryError())
+	}
+	if len(counts) != 1 || counts[fingerprint] != 3 {
+		t.Fatalf("expected 3 occurrences of %s, got %v", fingerprint, counts)
+	}
+
+	SetOccurrenceCounter(nil)
+	newQueryError()
+	if counts[fingerprint] != 3 {
+		t.Fatal("expected the counter to be removed")
+	}
+}
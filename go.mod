@@ -1,5 +1,5 @@
 module github.com/Invicton-Labs/go-stackerr
 
-go 1.18
+go 1.20
 
 require github.com/pkg/errors v0.9.1
@@ -0,0 +1,17 @@
+module github.com/Invicton-Labs/go-stackerr/grpcstatus
+
+go 1.20
+
+require (
+	github.com/Invicton-Labs/go-stackerr v0.0.0
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
+)
+
+replace github.com/Invicton-Labs/go-stackerr => ../
@@ -0,0 +1,126 @@
+// Package grpcstatus converts between stackerr.Error values and gRPC statuses.
+// It is a separate module so that the core stackerr package does not depend on gRPC.
+package grpcstatus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	stackerr "github.com/Invicton-Labs/go-stackerr"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// statusError is the error that is wrapped by a stackerr.Error
+// created from a gRPC status. It preserves the status code.
+type statusError struct {
+	st *status.Status
+}
+
+func (se *statusError) Error() string {
+	return se.st.Message()
+}
+
+func (se *statusError) GRPCStatus() *status.Status {
+	return se.st
+}
+
+type grpcStatuser interface {
+	GRPCStatus() *status.Status
+}
+
+// codeOf finds the gRPC code for an error. A code that is stored in the
+// stackerr.CodeField field (see codeFromField) takes precedence. Otherwise,
+// if any error in the chain carries a gRPC status, its code is used, and
+// if none does, the code is inferred from context errors, falling back
+// to codes.Unknown.
+func codeOf(err error) codes.Code {
+	if code, ok := codeFromField(err); ok {
+		return code
+	}
+	var gs grpcStatuser
+	if errors.As(err, &gs) {
+		return gs.GRPCStatus().Code()
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	}
+	return codes.Unknown
+}
+
+// codeFromField gets the gRPC code that is stored in the stackerr.CodeField
+// field of an error (e.g. with stackerr.Builder.Code), if there is one. The
+// field can be a codes.Code, or the name of a code in any case, with words
+// separated by underscores (e.g. "not_found" or "NOT_FOUND").
+func codeFromField(err error) (codes.Code, bool) {
+	var serr stackerr.Error
+	if !errors.As(err, &serr) {
+		return codes.Unknown, false
+	}
+	switch v := serr.Fields()[stackerr.CodeField].(type) {
+	case codes.Code:
+		return v, true
+	case string:
+		var code codes.Code
+		if code.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(v)))) == nil {
+			return code, true
+		}
+	}
+	return codes.Unknown, false
+}
+
+// ToGRPCStatus converts an error into a gRPC status. The status uses the
+// error's message as its message, and the fields of the stackerr.Error (if any)
+// are packed into a structpb.Struct detail.
+func ToGRPCStatus(err error) *status.Status {
+	if err == nil {
+		return nil
+	}
+	st := status.New(codeOf(err), err.Error())
+
+	var serr stackerr.Error
+	if !errors.As(err, &serr) || len(serr.Fields()) == 0 {
+		return st
+	}
+
+	// Round-trip the fields through JSON, so that any field
+	// value that can be marshaled can be packed into a Struct.
+	b, jerr := json.Marshal(serr.Fields())
+	if jerr != nil {
+		return st
+	}
+	fields := &structpb.Struct{}
+	if jerr := protojson.Unmarshal(b, fields); jerr != nil {
+		return st
+	}
+	if withDetails, derr := st.WithDetails(fields); derr == nil {
+		return withDetails
+	}
+	return st
+}
+
+// FromGRPCStatus converts a gRPC status into a stackerr.Error, using the
+// status's message as the error message and restoring any fields that were
+// packed by ToGRPCStatus. The status code is preserved, so converting the
+// resulting error back with ToGRPCStatus gives the same code. The stack trace
+// is captured at the point where this function was called.
+func FromGRPCStatus(st *status.Status) stackerr.Error {
+	if st == nil || st.Code() == codes.OK {
+		return nil
+	}
+	serr := stackerr.WrapWithFrameSkips(&statusError{st: st}, 1)
+	for _, detail := range st.Details() {
+		if fields, ok := detail.(*structpb.Struct); ok {
+			serr = serr.With(fields.AsMap())
+		}
+	}
+	return serr
+}
@@ -0,0 +1,75 @@
+package grpcstatus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	stackerr "github.com/Invicton-Labs/go-stackerr"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatusRoundTrip(t *testing.T) {
+	original := status.New(codes.NotFound, "user not found")
+	err := FromGRPCStatus(original).WithSingle("user", "alice").WithSingle("attempts", 3)
+	if err.Error() != "user not found" {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+
+	st := ToGRPCStatus(err)
+	if st.Code() != codes.NotFound || st.Message() != "user not found" {
+		t.Fatalf("unexpected status %v", st)
+	}
+
+	roundTripped := FromGRPCStatus(st)
+	if roundTripped.Error() != "user not found" {
+		t.Fatalf("unexpected message %q", roundTripped.Error())
+	}
+	fields := roundTripped.Fields()
+	// Numbers are restored as float64, since they're packed as JSON numbers
+	if fields["user"] != "alice" || fields["attempts"] != float64(3) {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	if ToGRPCStatus(roundTripped).Code() != codes.NotFound {
+		t.Fatal("expected the code to be preserved")
+	}
+}
+
+func TestToGRPCStatusInfersCode(t *testing.T) {
+	if ToGRPCStatus(nil) != nil {
+		t.Fatal("expected no status for a nil error")
+	}
+	if FromGRPCStatus(status.New(codes.OK, "")) != nil {
+		t.Fatal("expected no error for an OK status")
+	}
+	codesByErr := map[error]codes.Code{
+		stackerr.Wrap(context.Canceled):         codes.Canceled,
+		stackerr.Wrap(context.DeadlineExceeded): codes.DeadlineExceeded,
+		stackerr.Wrap(errors.New("base")):       codes.Unknown,
+	}
+	for err, code := range codesByErr {
+		if st := ToGRPCStatus(err); st.Code() != code || st.Message() != err.Error() {
+			t.Fatalf("expected code %v for %v, got %v", code, err, st)
+		}
+	}
+	// An error without fields has no details
+	if st := ToGRPCStatus(stackerr.Wrap(errors.New("base"))); len(st.Details()) != 0 {
+		t.Fatalf("expected no details, got %v", st.Details())
+	}
+}
+
+func TestToGRPCStatusCodeField(t *testing.T) {
+	// The code field takes precedence over the code inferred from the chain
+	err := stackerr.Build().Msgf("lookup: %w", context.DeadlineExceeded).Code("not_found").Err()
+	if st := ToGRPCStatus(err); st.Code() != codes.NotFound {
+		t.Fatalf("expected the code from the field, got %v", st.Code())
+	}
+	if st := ToGRPCStatus(stackerr.Wrap(context.Canceled).WithSingle(stackerr.CodeField, codes.Aborted)); st.Code() != codes.Aborted {
+		t.Fatalf("expected the code from the field, got %v", st.Code())
+	}
+	// A code that isn't a gRPC code is ignored
+	if st := ToGRPCStatus(stackerr.Wrap(context.Canceled).WithSingle(stackerr.CodeField, "E1234")); st.Code() != codes.Canceled {
+		t.Fatalf("expected the inferred code, got %v", st.Code())
+	}
+}
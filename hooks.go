@@ -0,0 +1,48 @@
+package stackerr
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// The registered wrap hooks, stored as a []func(Error) that is
+// replaced (never modified) whenever a hook is registered
+var wrapHooks atomic.Value
+
+// Protects registration of wrap hooks
+var wrapHooksLock sync.Mutex
+
+// RegisterWrapHook registers a function that is called whenever a stackerr.Error
+// is created (e.g. by Wrap, Errorf, or FromRecover), with the newly created error.
+// Hooks are called in the order they were registered. Hooks must not modify the
+// error they're given (e.g. with the InPlaceEditError methods), since it's the
+// same error that is returned to the caller.
+func RegisterWrapHook(hook func(err Error)) {
+	wrapHooksLock.Lock()
+	defer wrapHooksLock.Unlock()
+	existing, _ := wrapHooks.Load().([]func(Error))
+	hooks := make([]func(Error), len(existing), len(existing)+1)
+	copy(hooks, existing)
+	wrapHooks.Store(append(hooks, hook))
+}
+
+// RegisterSampledWrapHook is the same as RegisterWrapHook, except that the hook
+// is only called for approximately `rate` (between 0 and 1) of the errors that
+// are created, to bound its overhead on hot error paths. A rate of 0 or less
+// means the hook is never called, and a rate of 1 or more means it's always called.
+func RegisterSampledWrapHook(rate float64, hook func(err Error)) {
+	RegisterWrapHook(func(err Error) {
+		if rate >= 1 || (rate > 0 && rand.Float64() < rate) {
+			hook(err)
+		}
+	})
+}
+
+func runWrapHooks(err Error) {
+	countOccurrence(err)
+	hooks, _ := wrapHooks.Load().([]func(Error))
+	for _, hook := range hooks {
+		hook(err)
+	}
+}
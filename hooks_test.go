@@ -0,0 +1,110 @@
+package stackerr
+
+import (
+	"errors"
+	"testing"
+)
+
+// resetWrapHooks removes any wrap hooks that are registered during a test
+func resetWrapHooks(t *testing.T) {
+	existing, _ := wrapHooks.Load().([]func(Error))
+	t.Cleanup(func() {
+		wrapHooks.Store(existing)
+	})
+}
+
+func TestRegisterWrapHook(t *testing.T) {
+	resetWrapHooks(t)
+	var calls []string
+	var hooked []Error
+	RegisterWrapHook(func(err Error) {
+		calls = append(calls, "first")
+		hooked = append(hooked, err)
+	})
+	RegisterWrapHook(func(err Error) {
+		calls = append(calls, "second")
+	})
+
+	created := []Error{
+		Wrap(errors.New("bad gateway")),
+		Errorf("failed: %d", 1),
+		panicAndRecoverDirectly(),
+	}
+	if len(hooked) != len(created) {
+		t.Fatalf("expected the hooks to be called %d times, got %d", len(created), len(hooked))
+	}
+	for i, err := range created {
+		if hooked[i] != err {
+			t.Fatalf("expected hook %d to be called with the created error", i)
+		}
+		if calls[2*i] != "first" || calls[2*i+1] != "second" {
+			t.Fatalf("expected the hooks to be called in registration order, got %v", calls)
+		}
+	}
+}
+
+func TestRegisterSampledWrapHook(t *testing.T) {
+	resetWrapHooks(t)
+	const iterations = 10000
+	var never, always, half int
+	RegisterSampledWrapHook(0, func(err Error) { never++ })
+	RegisterSampledWrapHook(1, func(err Error) { always++ })
+	RegisterSampledWrapHook(0.5, func(err Error) { half++ })
+
+	base := errors.New("no such host")
+	for i := 0; i < iterations; i++ {
+		Wrap(base)
+	}
+	if never != 0 {
+		t.Fatalf("expected a rate of 0 to never call the hook, got %d calls", never)
+	}
+	if always != iterations {
+		t.Fatalf("expected a rate of 1 to always call the hook, got %d calls", always)
+	}
+	// Far more than enough standard deviations (50) that this doesn't flake
+	if half < 4500 || half > 5500 {
+		t.Fatalf("expected about %d calls for a rate of 0.5, got %d", iterations/2, half)
+	}
+}
+
+func TestReconstructRunsWrapHooks(t *testing.T) {
+	resetWrapHooks(t)
+	var hooked Error
+	RegisterWrapHook(func(err Error) {
+		hooked = err
+	})
+	err := Reconstruct("query failed", Stacks{{{Function: "main.main", File: "main.go", Line: 3}}}, map[string]any{"user": "alice"})
+	if hooked != err || hooked.Fields()["user"] != "alice" {
+		t.Fatalf("expected the hook to be called with the finished error, got %v", hooked)
+	}
+}
+
+// A stackerr.Error that isn't a *stackError (the alias lets it be embedded, since
+// a field named Error would hide the Error method)
+type (
+	embeddedStackError = Error
+	embeddedError      struct {
+		embeddedStackError
+	}
+)
+
+func TestWithKindRunsWrapHooks(t *testing.T) {
+	resetWrapHooks(t)
+	var hooked []Error
+	RegisterWrapHook(func(err Error) {
+		hooked = append(hooked, err)
+	})
+	inner := Wrap(errors.New("rate limited"))
+	err := WithKind(embeddedError{inner}, httpKind(429))
+	if len(hooked) != 2 || hooked[1] != err {
+		t.Fatalf("expected the hook to be called for the new error, got %v", hooked)
+	}
+	if kind, ok := KindOf[httpKind](hooked[1]); !ok || kind != 429 {
+		t.Fatalf("expected the hook to see the kind, got %v", kind)
+	}
+	// Setting a kind on a stackerr.Error from this package doesn't wrap it
+	WithKind(inner, httpKind(500))
+	if len(hooked) != 2 {
+		t.Fatalf("expected no hook call without wrapping, got %d calls", len(hooked))
+	}
+}
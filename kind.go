@@ -0,0 +1,50 @@
+package stackerr
+
+import "reflect"
+
+// WithKind returns a copy of the error with a strongly-typed kind (e.g. a value of
+// an enum type that classifies the error), overwriting any existing kind of the same
+// type. Kinds are keyed by their type, so kinds of different types don't collide.
+// If the error isn't a stackerr.Error created by this package, it's wrapped (as with
+// WrapWithoutExtraStack) first. See KindOf.
+func WithKind[T comparable](err Error, kind T) Error {
+	if err == nil {
+		return nil
+	}
+	var newStackError *stackError
+	serr, isStackError := err.(*stackError)
+	if isStackError {
+		newStackError = serr.clone()
+	} else {
+		newStackError = wrapError(err, 1, false, collapseParentStacks.Load())
+	}
+	// Make a new map, since the existing one may be shared
+	kinds := make(map[reflect.Type]any, len(newStackError.Kinds)+1)
+	for k, v := range newStackError.Kinds {
+		kinds[k] = v
+	}
+	kinds[reflect.TypeOf((*T)(nil)).Elem()] = kind
+	newStackError.Kinds = kinds
+	if !isStackError {
+		runWrapHooks(newStackError)
+	}
+	return newStackError
+}
+
+// KindOf gets the kind of type T of an error (see WithKind), from the outermost
+// stackerr.Error in its chain that has one. The boolean is false if no
+// stackerr.Error in the chain has a kind of type T.
+func KindOf[T comparable](err error) (T, bool) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	var kind T
+	found := false
+	walkChain(err, func(err error) bool {
+		if serr, ok := err.(*stackError); ok {
+			if v, ok := serr.Kinds[t]; ok {
+				kind, found = v.(T)
+			}
+		}
+		return !found
+	})
+	return kind, found
+}
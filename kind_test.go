@@ -0,0 +1,46 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Two kind types with the same underlying type, which must not collide
+type (
+	httpKind  int
+	retryKind int
+)
+
+func TestKinds(t *testing.T) {
+	err := WithKind(Wrap(errors.New("rate limited")), httpKind(404))
+	err = WithKind(err, retryKind(3))
+	if kind, ok := KindOf[httpKind](err); !ok || kind != 404 {
+		t.Fatalf("expected an HTTP kind of 404, got %v", kind)
+	}
+	if kind, ok := KindOf[retryKind](err); !ok || kind != 3 {
+		t.Fatalf("expected a retry kind of 3, got %v", kind)
+	}
+	if _, ok := KindOf[int](err); ok {
+		t.Fatal("expected no kind of the underlying type")
+	}
+
+	// Kinds are found through other errors, and the outermost one wins
+	outer := WithKind(Wrap(fmt.Errorf("outer: %w", err)), httpKind(500))
+	if kind, _ := KindOf[httpKind](outer); kind != 500 {
+		t.Fatalf("expected the outermost kind, got %v", kind)
+	}
+	if kind, _ := KindOf[retryKind](outer); kind != 3 {
+		t.Fatalf("expected the inner kind, got %v", kind)
+	}
+	// Setting a kind doesn't change the original error
+	if kind, _ := KindOf[httpKind](err); kind != 404 {
+		t.Fatalf("expected the original kind, got %v", kind)
+	}
+	if _, ok := KindOf[httpKind](errors.New("rate limited")); ok {
+		t.Fatal("expected no kind for a plain error")
+	}
+	if WithKind[httpKind](nil, 404) != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+}
@@ -0,0 +1,96 @@
+package stackerr
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// The separator between the segments of a wrapped error message
+const messageSegmentSeparator string = ": "
+
+// DedupeMessage gets the message of an error, with any consecutive duplicate
+// segments (separated by ": ") collapsed into one, e.g. "load config: load config:
+// open file" becomes "load config: open file". This is only for display, and
+// does not change the error's message.
+func DedupeMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	segments := strings.Split(err.Error(), messageSegmentSeparator)
+	deduped := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		if i > 0 && segment == segments[i-1] {
+			continue
+		}
+		deduped = append(deduped, segment)
+	}
+	return strings.Join(deduped, messageSegmentSeparator)
+}
+
+// The default regexp that ExtractFields uses to find key-value pairs in messages
+var defaultFieldExtractionRegexp = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_.-]*)=(\S+)`)
+
+// The regexp that ExtractFields uses to find key-value pairs in messages
+var fieldExtractionRegexp = newAtomicPointer(defaultFieldExtractionRegexp)
+
+// SetFieldExtractionRegexp sets the regexp that ExtractFields uses to find key-value
+// pairs in error messages. The first submatch is the key, and the second is the
+// value. Defaults to matching tokens of the form "key=value", and a nil regexp
+// restores the default.
+func SetFieldExtractionRegexp(re *regexp.Regexp) {
+	if re == nil {
+		re = defaultFieldExtractionRegexp
+	}
+	fieldExtractionRegexp.Store(re)
+}
+
+// Whether ExtractFields should remove the key-value pairs from the message
+var stripExtractedFields atomic.Bool
+
+// SetStripExtractedFields sets whether ExtractFields should remove the key-value
+// pairs that it extracts from the error message. Defaults to false.
+func SetStripExtractedFields(strip bool) {
+	stripExtractedFields.Store(strip)
+}
+
+// ExtractFields converts an error into a stackerr.Error (without adding a stack if
+// it already has one), with the key-value pairs in its message (see
+// SetFieldExtractionRegexp) added as fields, e.g. for messages from legacy code
+// like "failed to connect host=db1 port=5432". Extracted values are strings, and
+// they don't overwrite existing fields with the same key. If SetStripExtractedFields
+// is enabled, the pairs are also removed from the message, but the original error
+// can still be found with errors.Is and errors.As.
+func ExtractFields(err error) Error {
+	if err == nil {
+		return nil
+	}
+	re := fieldExtractionRegexp.Load()
+	message := err.Error()
+	matches := re.FindAllStringSubmatch(message, -1)
+	if len(matches) == 0 {
+		return new(err, 1, false)
+	}
+
+	se := wrapError(err, 1, false, collapseParentStacks.Load())
+	fields := make(map[string]any, len(matches))
+	for _, match := range matches {
+		if len(match) < 3 {
+			continue
+		}
+		if _, ok := se.MetaFields[match[1]]; !ok {
+			fields[match[1]] = match[2]
+		}
+	}
+	se.WithInPlace(fields)
+	if stripExtractedFields.Load() {
+		stripped := strings.Join(strings.Fields(re.ReplaceAllString(message, "")), " ")
+		se.Err = &translatedError{
+			err:      errors.New(stripped),
+			original: se.Err,
+		}
+	}
+	runWrapHooks(se)
+	return se
+}
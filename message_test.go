@@ -0,0 +1,68 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func TestDedupeMessage(t *testing.T) {
+	if DedupeMessage(nil) != "" {
+		t.Fatal("expected an empty message for a nil error")
+	}
+	base := errors.New("open file: not found")
+	duplicated := fmt.Errorf("load config: %w", fmt.Errorf("load config: %w", base))
+	if msg := DedupeMessage(duplicated); msg != "load config: open file: not found" {
+		t.Fatalf("expected the duplicate segment to be collapsed, got %q", msg)
+	}
+	// The stored message isn't changed
+	if duplicated.Error() != "load config: load config: open file: not found" {
+		t.Fatalf("unexpected message %q", duplicated.Error())
+	}
+
+	clean := fmt.Errorf("load config: %w", base)
+	if msg := DedupeMessage(clean); msg != clean.Error() {
+		t.Fatalf("expected the message to be unchanged, got %q", msg)
+	}
+}
+
+func TestExtractFields(t *testing.T) {
+	if ExtractFields(nil) != nil {
+		t.Fatal("expected nil for a nil error")
+	}
+	base := errors.New("failed to connect host=db1 port=5432")
+	err := ExtractFields(Wrap(base).WithSingle("host", "primary"))
+	fields := err.Fields()
+	// Existing fields aren't overwritten
+	if fields["port"] != "5432" || fields["host"] != "primary" {
+		t.Fatalf("expected the extracted fields, got %v", fields)
+	}
+	if err.Error() != base.Error() {
+		t.Fatalf("expected the message to be unchanged, got %q", err.Error())
+	}
+
+	defer SetStripExtractedFields(false)
+	SetStripExtractedFields(true)
+	stripped := ExtractFields(base)
+	if fields := stripped.Fields(); fields["host"] != "db1" || fields["port"] != "5432" {
+		t.Fatalf("expected the extracted fields, got %v", fields)
+	}
+	if stripped.Error() != "failed to connect" || !errors.Is(stripped, base) {
+		t.Fatalf("expected the pairs to be removed from the message, got %q", stripped.Error())
+	}
+}
+
+func TestSetFieldExtractionRegexp(t *testing.T) {
+	defer SetFieldExtractionRegexp(fieldExtractionRegexp.Load())
+	SetFieldExtractionRegexp(regexp.MustCompile(`(\w+): (\w+)`))
+	err := ExtractFields(errors.New("request failed, status: 503"))
+	if fields := err.Fields(); len(fields) != 1 || fields["status"] != "503" {
+		t.Fatalf("expected the field from the custom regexp, got %v", fields)
+	}
+	SetFieldExtractionRegexp(nil)
+	err = ExtractFields(errors.New("failed to connect host=db1"))
+	if fields := err.Fields(); len(fields) != 1 || fields["host"] != "db1" {
+		t.Fatalf("expected a nil regexp to restore the default, got %v", fields)
+	}
+}
@@ -0,0 +1,41 @@
+// Package msgpackcodec serializes stackerr.Error values to and from msgpack.
+// It is a separate module so that the core stackerr package does not depend on msgpack.
+package msgpackcodec
+
+import (
+	"encoding/json"
+
+	stackerr "github.com/Invicton-Labs/go-stackerr"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MarshalMsgpack marshals a stackerr.Error to msgpack. The msgpack form has
+// the same structure as the JSON form of the error, so it includes the
+// message, stacks, and fields.
+func MarshalMsgpack(err stackerr.Error) ([]byte, error) {
+	// Go via the JSON form, so that the msgpack form always
+	// has the same structure as the JSON form.
+	b, jerr := err.MarshalJSON()
+	if jerr != nil {
+		return nil, jerr
+	}
+	var structured map[string]any
+	if jerr := json.Unmarshal(b, &structured); jerr != nil {
+		return nil, jerr
+	}
+	return msgpack.Marshal(structured)
+}
+
+// UnmarshalMsgpack unmarshals a stackerr.Error from its msgpack form. As with
+// stackerr.UnmarshalError, the wrapped error is reconstructed from its message.
+func UnmarshalMsgpack(data []byte) (stackerr.Error, error) {
+	var structured map[string]any
+	if err := msgpack.Unmarshal(data, &structured); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(structured)
+	if err != nil {
+		return nil, err
+	}
+	return stackerr.UnmarshalError(b)
+}
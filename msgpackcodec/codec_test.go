@@ -0,0 +1,41 @@
+package msgpackcodec
+
+import (
+	"errors"
+	"testing"
+
+	stackerr "github.com/Invicton-Labs/go-stackerr"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	err := stackerr.Wrap(errors.New("base")).WithSingle("user", "alice").WithSingle("attempts", 3)
+	b, merr := MarshalMsgpack(err)
+	if merr != nil {
+		t.Fatal(merr)
+	}
+	unmarshaled, merr := UnmarshalMsgpack(b)
+	if merr != nil {
+		t.Fatal(merr)
+	}
+
+	if unmarshaled.Error() != err.Error() {
+		t.Fatalf("expected message %q, got %q", err.Error(), unmarshaled.Error())
+	}
+	if !unmarshaled.Stacks().Equal(err.Stacks()) {
+		t.Fatalf("expected stacks %v, got %v", err.Stacks(), unmarshaled.Stacks())
+	}
+	// Numbers are restored as float64, the same as with the JSON form
+	fields := unmarshaled.Fields()
+	if len(fields) != 2 || fields["user"] != "alice" || fields["attempts"] != float64(3) {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	if errors.Unwrap(unmarshaled) == nil {
+		t.Fatal("expected the wrapped error to be reconstructed")
+	}
+}
+
+func TestUnmarshalMsgpackInvalid(t *testing.T) {
+	if _, err := UnmarshalMsgpack([]byte{0xc1}); err == nil {
+		t.Fatal("expected an error for invalid msgpack")
+	}
+}
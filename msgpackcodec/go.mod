@@ -0,0 +1,15 @@
+module github.com/Invicton-Labs/go-stackerr/msgpackcodec
+
+go 1.20
+
+require (
+	github.com/Invicton-Labs/go-stackerr v0.0.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+)
+
+require (
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+)
+
+replace github.com/Invicton-Labs/go-stackerr => ../
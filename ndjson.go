@@ -0,0 +1,66 @@
+package stackerr
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// WriteNDJSON writes errors as newline-delimited JSON, with the JSON form of
+// each error on its own line. Nil errors are skipped. Errors that are not a
+// stackerr.Error are written with the stacks and fields of the first
+// stackerr.Error in their chain, if there is one.
+func WriteNDJSON(w io.Writer, errs []error) error {
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		serr, ok := err.(Error)
+		if !ok {
+			se := &stackError{
+				Err: err,
+			}
+			var inner *stackError
+			if errors.As(err, &inner) {
+				se.StackTraces = inner.StackTraces
+				se.StackMetas = inner.StackMetas
+				se.MetaFields = inner.MetaFields
+				se.Level = inner.Level
+				se.PrivateKeys = inner.PrivateKeys
+				se.RelatedErrors = inner.RelatedErrors
+				se.Attachments = inner.Attachments
+				se.Kinds = inner.Kinds
+			}
+			serr = se
+		}
+		b, merr := serr.MarshalJSON()
+		if merr != nil {
+			return merr
+		}
+		if _, werr := w.Write(append(b, '\n')); werr != nil {
+			return werr
+		}
+	}
+	return nil
+}
+
+// ReadNDJSON reads errors that were written as newline-delimited JSON by WriteNDJSON.
+func ReadNDJSON(r io.Reader) ([]Error, error) {
+	errs := []Error{}
+	decoder := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errs, err
+		}
+		serr, err := UnmarshalError(raw)
+		if err != nil {
+			return errs, err
+		}
+		errs = append(errs, serr)
+	}
+	return errs, nil
+}
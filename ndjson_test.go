@@ -0,0 +1,58 @@
+package stackerr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNDJSONRoundTrip(t *testing.T) {
+	errs := []error{
+		Wrap(errors.New("first")).WithSingle("user", "alice"),
+		nil,
+		fmt.Errorf("second: %w", Wrap(errors.New("inner")).WithSingle("attempt", "2")),
+		errors.New("third"),
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteNDJSON(buf, errs); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 3 {
+		t.Fatalf("expected 3 lines, got %d", lines)
+	}
+
+	read, err := ReadNDJSON(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 3 {
+		t.Fatalf("expected 3 errors, got %d", len(read))
+	}
+	expected := []struct {
+		message string
+		fields  map[string]any
+		stacks  int
+	}{
+		{"first", map[string]any{"user": "alice"}, 1},
+		{"second: inner", map[string]any{"attempt": "2"}, 1},
+		{"third", map[string]any{}, 0},
+	}
+	for i, e := range expected {
+		if read[i].Error() != e.message || fmt.Sprint(read[i].Fields()) != fmt.Sprint(e.fields) || len(read[i].Stacks()) != e.stacks {
+			t.Fatalf("error %d: expected %q with fields %v and %d stacks, got %q with fields %v and %d stacks",
+				i, e.message, e.fields, e.stacks, read[i].Error(), read[i].Fields(), len(read[i].Stacks()))
+		}
+	}
+	if !read[0].Stacks().Equal(errs[0].(Error).Stacks()) {
+		t.Fatal("expected the stacks to round trip")
+	}
+}
+
+func TestReadNDJSONInvalid(t *testing.T) {
+	read, err := ReadNDJSON(strings.NewReader("{\"_v\":1,\"err\":\"first\"}\nnot json\n"))
+	if err == nil || len(read) != 1 {
+		t.Fatalf("expected the valid errors and an error, got %d errors and %v", len(read), err)
+	}
+}
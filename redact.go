@@ -0,0 +1,45 @@
+package stackerr
+
+import (
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// A registered message redactor
+type messageRedactor struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// The registered message redactors, stored as a []messageRedactor that
+// is replaced (never modified) whenever a redactor is registered
+var messageRedactors atomic.Value
+
+// Protects registration of message redactors
+var messageRedactorsLock sync.Mutex
+
+// RegisterMessageRedactor registers a regexp that is used to redact error messages
+// returned by SafeError. Each match of the regexp is replaced with `replacement`,
+// which can refer to submatches as in regexp.Regexp.ReplaceAllString. Redactors
+// are applied in the order they were registered.
+func RegisterMessageRedactor(re *regexp.Regexp, replacement string) {
+	messageRedactorsLock.Lock()
+	defer messageRedactorsLock.Unlock()
+	existing, _ := messageRedactors.Load().([]messageRedactor)
+	redactors := make([]messageRedactor, len(existing), len(existing)+1)
+	copy(redactors, existing)
+	messageRedactors.Store(append(redactors, messageRedactor{
+		re:          re,
+		replacement: replacement,
+	}))
+}
+
+// redactMessage applies all registered message redactors to a message.
+func redactMessage(message string) string {
+	redactors, _ := messageRedactors.Load().([]messageRedactor)
+	for _, redactor := range redactors {
+		message = redactor.re.ReplaceAllString(message, redactor.replacement)
+	}
+	return message
+}
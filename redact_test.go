@@ -0,0 +1,32 @@
+package stackerr
+
+import (
+	"regexp"
+	"testing"
+)
+
+// resetMessageRedactors removes any message redactors that are registered during a test
+func resetMessageRedactors(t *testing.T) {
+	existing, _ := messageRedactors.Load().([]messageRedactor)
+	t.Cleanup(func() {
+		messageRedactors.Store(existing)
+	})
+}
+
+func TestSafeError(t *testing.T) {
+	resetMessageRedactors(t)
+	err := Errorf("request from alice@example.com failed with header Authorization: Bearer abc.def-123")
+	if err.SafeError() != err.Error() {
+		t.Fatal("expected the message to be unchanged without redactors")
+	}
+
+	RegisterMessageRedactor(regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.]+`), "[email]")
+	RegisterMessageRedactor(regexp.MustCompile(`(Bearer) [\w.-]+`), "$1 [token]")
+	expected := "request from [email] failed with header Authorization: Bearer [token]"
+	if safe := err.SafeError(); safe != expected {
+		t.Fatalf("expected %q, got %q", expected, safe)
+	}
+	if err.Error() == expected {
+		t.Fatal("expected Error to be unchanged")
+	}
+}
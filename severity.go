@@ -0,0 +1,59 @@
+package stackerr
+
+import (
+	"strings"
+)
+
+// Severity is the severity level of a stackerr.Error.
+type Severity int
+
+const (
+	// The zero value means that no severity has been set
+	severityUnset Severity = iota
+	SeverityDebug
+	SeverityInfo
+	SeverityWarn
+	SeverityError
+	SeverityFatal
+)
+
+// String returns the name of the severity level, e.g. "warn".
+func (s Severity) String() string {
+	switch s {
+	case SeverityDebug:
+		return "debug"
+	case SeverityInfo:
+		return "info"
+	case SeverityWarn:
+		return "warn"
+	case SeverityError:
+		return "error"
+	case SeverityFatal:
+		return "fatal"
+	}
+	return ""
+}
+
+// parseSeverity parses a severity from its name, as returned by String.
+func parseSeverity(name string) (Severity, bool) {
+	for s := SeverityDebug; s <= SeverityFatal; s++ {
+		if strings.EqualFold(name, s.String()) {
+			return s, true
+		}
+	}
+	return severityUnset, false
+}
+
+// SeverityOf gets the severity of an error, from the outermost stackerr.Error
+// in its chain that has a severity. The boolean is false if no stackerr.Error
+// in the chain has a severity.
+func SeverityOf(err error) (Severity, bool) {
+	level := severityUnset
+	walkChain(err, func(err error) bool {
+		if serr, ok := err.(*stackError); ok && serr.Level != severityUnset {
+			level = serr.Level
+		}
+		return level == severityUnset
+	})
+	return level, level != severityUnset
+}
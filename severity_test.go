@@ -0,0 +1,88 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSeverity(t *testing.T) {
+	base := errors.New("checksum mismatch")
+	if _, ok := SeverityOf(base); ok {
+		t.Fatal("expected no severity for a plain error")
+	}
+	if _, ok := SeverityOf(Wrap(base)); ok {
+		t.Fatal("expected no severity by default")
+	}
+
+	warn := Wrap(base).WithSeverity(SeverityWarn)
+	if level, ok := SeverityOf(warn); !ok || level != SeverityWarn {
+		t.Fatalf("expected warn, got %v", level)
+	}
+	// Wrapping keeps the severity, and overriding it doesn't change the original
+	if level, _ := SeverityOf(Wrap(warn)); level != SeverityWarn {
+		t.Fatalf("expected the severity to be kept, got %v", level)
+	}
+	if level, _ := SeverityOf(warn.WithSeverity(SeverityFatal)); level != SeverityFatal {
+		t.Fatalf("expected fatal, got %v", level)
+	}
+	if level, _ := SeverityOf(warn); level != SeverityWarn {
+		t.Fatal("expected the original severity not to be changed")
+	}
+
+	// The outermost severity in the chain wins
+	outer := Wrap(fmt.Errorf("outer: %w", warn)).WithSeverity(SeverityError)
+	if level, _ := SeverityOf(outer); level != SeverityError {
+		t.Fatalf("expected the outermost severity, got %v", level)
+	}
+	if level, _ := SeverityOf(fmt.Errorf("outer: %w", Wrap(fmt.Errorf("middle: %w", warn)))); level != SeverityWarn {
+		t.Fatalf("expected the inner severity when outer layers have none, got %v", level)
+	}
+}
+
+func TestSeverityString(t *testing.T) {
+	names := map[Severity]string{
+		severityUnset: "",
+		SeverityDebug: "debug",
+		SeverityInfo:  "info",
+		SeverityWarn:  "warn",
+		SeverityError: "error",
+		SeverityFatal: "fatal",
+	}
+	for level, name := range names {
+		if level.String() != name {
+			t.Fatalf("expected %q, got %q", name, level.String())
+		}
+		if parsed, ok := parseSeverity(name); name != "" && (!ok || parsed != level) {
+			t.Fatalf("expected %q to parse to %v", name, level)
+		}
+	}
+}
+
+func TestMinStackCaptureSeverity(t *testing.T) {
+	defer SetMinStackCaptureSeverity(SeverityDebug)
+	SetMinStackCaptureSeverity(SeverityWarn)
+	base := errors.New("quota exceeded")
+
+	info := WrapSeverity(SeverityInfo, base).WithSingle("key", "value")
+	if n := len(info.Stacks()); n != 0 {
+		t.Fatalf("expected no stack below the threshold, got %d", n)
+	}
+	if info.Error() != "quota exceeded" || info.Fields()["key"] != "value" {
+		t.Fatal("expected the message and fields to be kept")
+	}
+	// Wrapping an error with a low severity doesn't capture a stack either
+	if n := len(Wrap(info).Stacks()); n != 0 {
+		t.Fatalf("expected no stack when wrapping below the threshold, got %d", n)
+	}
+
+	for _, level := range []Severity{SeverityWarn, SeverityError} {
+		if n := len(WrapSeverity(level, base).Stacks()); n != 1 {
+			t.Fatalf("expected a stack for %v, got %d", level, n)
+		}
+	}
+	// Errors without a severity always have a stack
+	if n := len(Wrap(base).Stacks()); n != 1 {
+		t.Fatalf("expected a stack without a severity, got %d", n)
+	}
+}
@@ -1,12 +1,21 @@
 package stackerr
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type Stack []runtime.Frame
@@ -17,6 +26,28 @@ func NewStack(frames []runtime.Frame) Stack {
 	return frames
 }
 
+// StackEntry is a single frame of a stack, for building a Stack from
+// stack information in another form (see StackFromEntries).
+type StackEntry struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// StackFromEntries creates a new Stack from a slice of entries,
+// ordered from the newest frame to the oldest.
+func StackFromEntries(entries []StackEntry) Stack {
+	frames := make(Stack, 0, len(entries))
+	for _, entry := range entries {
+		frames = append(frames, runtime.Frame{
+			Function: entry.Function,
+			File:     entry.File,
+			Line:     entry.Line,
+		})
+	}
+	return frames
+}
+
 // NewStacks creates a new Stacks from a slice of Stack.
 func NewStacks(stacks []Stack) Stacks {
 	return stacks
@@ -34,41 +65,295 @@ func NewStacksFromFrames(stacks [][]runtime.Frame) Stacks {
 // A regexp for parsing console stack traces
 var consoleStackRegexp *regexp.Regexp = regexp.MustCompile(`(?m)^[ \t]*([^\n]+)\n[ \t]+([^\n]+):([0-9]+)[ \t]*$`)
 
+// The prefix of a stack trace in testify's failure output
+const testifyTracePrefix string = "Error Trace:"
+
+// A regexp for parsing the file:line entries of testify stack traces
+var testifyTraceLineRegexp *regexp.Regexp = regexp.MustCompile(`^[ \t]*([^ \t\n][^\n]*):([0-9]+)[ \t]*$`)
+
+// parseTestifyTraces parses stack traces in testify's failure output format, where
+// the "Error Trace:" prefix is followed by lines with a file:line entry. Since the
+// entries have no function names, the frames have an empty Function.
+func parseTestifyTraces(block string) Stacks {
+	stacks := Stacks{}
+	var stack Stack
+	for _, line := range strings.Split(block, "\n") {
+		if idx := strings.Index(line, testifyTracePrefix); idx >= 0 {
+			if len(stack) > 0 {
+				stacks = append(stacks, stack)
+			}
+			stack = Stack{}
+			line = line[idx+len(testifyTracePrefix):]
+		} else if stack == nil {
+			continue
+		}
+		match := testifyTraceLineRegexp.FindStringSubmatch(line)
+		if match == nil {
+			// The trace ends at the first line that isn't a file:line entry
+			if len(stack) > 0 {
+				stacks = append(stacks, stack)
+			}
+			stack = nil
+			continue
+		}
+		lineNum, _ := strconv.ParseInt(match[2], 10, 32)
+		stack = append(stack, runtime.Frame{
+			File: match[1],
+			Line: int(lineNum),
+		})
+	}
+	if len(stack) > 0 {
+		stacks = append(stacks, stack)
+	}
+	return stacks
+}
+
 // Format formats the stacks into a human-readable string
 func (s Stacks) Format() string {
-	ret := stackDivider + "\n"
+	sb := &strings.Builder{}
+	s.writeFormatted(sb)
+	return sb.String()
+}
+
+// writeFormatted writes the human-readable form of the stacks (see Format).
+func (s Stacks) writeFormatted(w io.Writer) {
+	s.writeFormattedWithMeta(w, nil)
+}
+
+// writeFormattedWithMeta writes the human-readable form of the stacks (see Format),
+// where the label of each stack (if it has one) is included in brackets on its first line.
+func (s Stacks) writeFormattedWithMeta(w io.Writer, metas stackMetas) {
+	io.WriteString(w, stackDivider+"\n")
 	for i, stack := range s {
-		ret += stack.Format() + "\n" + stackDivider
+		stack.writeFormattedWith(w, metas.at(i).Label, nil, nil)
+		io.WriteString(w, "\n"+stackDivider)
 		if i != len(s)-1 {
-			ret += "\n"
+			io.WriteString(w, "\n")
 		}
 	}
-	return ret
 }
 
-func (s Stack) trimStack() Stack {
-	// Trim off any final frames that are part of the runtime, not our main code
+// WriteTo writes the human-readable form of the stacks (see Format) to a
+// writer, without building the entire output in memory first.
+func (s Stacks) WriteTo(w io.Writer) (int64, error) {
+	return writeBuffered(w, s.writeFormatted)
+}
+
+// countingWriter counts the bytes written to a writer, and
+// stops writing after the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// writeBuffered calls `write` with a buffered writer that wraps `w`, and
+// returns the number of bytes written and the first error, if any.
+func writeBuffered(w io.Writer, write func(io.Writer)) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	write(bw)
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+// String formats the stacks into a human-readable string, the same as Format.
+func (s Stacks) String() string {
+	return s.Format()
+}
+
+// GoString formats the stacks into a compact string (see Stack.GoString),
+// for use with the %#v verb.
+func (s Stacks) GoString() string {
+	stacks := make([]string, 0, len(s))
+	for _, stack := range s {
+		stacks = append(stacks, stack.GoString())
+	}
+	return "stackerr.Stacks{" + strings.Join(stacks, ", ") + "}"
+}
+
+// The function name prefix for frames that belong to this package
+const packageFunctionPrefix string = "github.com/Invicton-Labs/go-stackerr."
+
+// Whether leading frames that belong to this package should be trimmed
+var trimInternalFrames atomic.Bool
+
+// SetTrimInternalFrames sets whether leading frames that belong to this
+// package (e.g. frames from stack capture or wrapping functions) should be
+// trimmed when formatting or marshaling stacks. Leading frames that belong
+// to the runtime are always trimmed. Defaults to false.
+func SetTrimInternalFrames(trim bool) {
+	trimInternalFrames.Store(trim)
+}
+
+func isLeadingFrameTrimmed(frame runtime.Frame) bool {
+	if strings.HasPrefix(frame.Function, "runtime.") {
+		return true
+	}
+	// Frames from this package's own tests are not considered internal
+	return trimInternalFrames.Load() && strings.HasPrefix(frame.Function, packageFunctionPrefix) && !strings.HasSuffix(frame.File, "_test.go")
+}
+
+// Whether trailing frames that belong to the testing package should be trimmed
+var trimTestFrames atomic.Bool
+
+// SetTrimTestFrames sets whether trailing frames that belong to the testing
+// package (e.g. testing.tRunner) should be trimmed when formatting or
+// marshaling stacks. Defaults to false.
+func SetTrimTestFrames(trim bool) {
+	trimTestFrames.Store(trim)
+}
+
+func isTrailingFrameTrimmed(frame runtime.Frame) bool {
+	if strings.HasPrefix(frame.Function, "runtime.") {
+		return true
+	}
+	return trimTestFrames.Load() && strings.HasPrefix(frame.Function, "testing.")
+}
+
+// trimBounds gets the index of the first and last frames of the stack that
+// should be kept after trimming.
+func (s Stack) trimBounds() (int, int) {
+	// Trim off any leading frames that are part of the runtime (or, optionally,
+	// this package), so the first frame is always in our main code
+	firstFrameIdx := 0
+	for firstFrameIdx < len(s) && isLeadingFrameTrimmed(s[firstFrameIdx]) {
+		firstFrameIdx++
+	}
+	// Trim off any final frames that are part of the runtime (or, optionally,
+	// the testing package), not our main code
 	lastFrameIdx := len(s) - 1
-	for lastFrameIdx >= 0 && strings.HasPrefix(s[lastFrameIdx].Function, "runtime.") {
+	for lastFrameIdx >= firstFrameIdx && isTrailingFrameTrimmed(s[lastFrameIdx]) {
 		lastFrameIdx--
 	}
-	return s[0 : lastFrameIdx+1]
+	return firstFrameIdx, lastFrameIdx
 }
 
-func (s Stack) MarshalJSON() ([]byte, error) {
-	type jsonFrame struct {
-		Function string `json:"function"`
-		File     string `json:"file"`
-		Line     int    `json:"line"`
+// The JSON representation of a set of stacks
+type jsonStacks struct {
+	Count  int     `json:"count"`
+	Stacks []Stack `json:"stacks"`
+}
+
+func (s Stacks) MarshalJSON() ([]byte, error) {
+	stacks := []Stack(s)
+	if stacks == nil {
+		stacks = []Stack{}
 	}
+	return json.Marshal(jsonStacks{
+		Count:  len(stacks),
+		Stacks: stacks,
+	})
+}
 
-	ts := s.trimStack()
-	jFrames := make([]jsonFrame, len(ts))
-	for i, frame := range ts {
-		jFrames[i] = jsonFrame{
-			Function: frame.Function,
-			File:     frame.File,
-			Line:     frame.Line,
+// UnmarshalJSON unmarshals a set of stacks from either its JSON object
+// form (as produced by MarshalJSON) or a bare JSON array of stacks.
+func (s *Stacks) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		stacks := []Stack{}
+		if err := json.Unmarshal(trimmed, &stacks); err != nil {
+			return err
+		}
+		*s = stacks
+		return nil
+	}
+	js := jsonStacks{}
+	if err := json.Unmarshal(trimmed, &js); err != nil {
+		return err
+	}
+	*s = js.Stacks
+	return nil
+}
+
+func (s Stack) trimStack() Stack {
+	firstFrameIdx, lastFrameIdx := s.trimBounds()
+	return s[firstFrameIdx : lastFrameIdx+1]
+}
+
+// Whether backslashes in file paths should be converted to forward slashes in output
+var normalizePathSeparators atomic.Bool
+
+// SetNormalizePathSeparators sets whether backslashes in file paths (e.g. on Windows)
+// should be converted to forward slashes when formatting or marshaling stacks, so
+// that paths are consistent across operating systems. Defaults to false.
+func SetNormalizePathSeparators(normalize bool) {
+	normalizePathSeparators.Store(normalize)
+}
+
+// outputFilePath gets the form of a file path to use when formatting or marshaling stacks.
+func outputFilePath(file string) string {
+	if normalizePathSeparators.Load() {
+		return strings.ReplaceAll(file, "\\", "/")
+	}
+	return file
+}
+
+// Whether the JSON representation of a frame should include its package
+var includeFramePackage atomic.Bool
+
+// SetIncludeFramePackage sets whether marshaling a stack to JSON should include a
+// separate "package" field for each frame, with the import path of the frame's
+// function (e.g. "github.com/x/y/z" for "github.com/x/y/z.(*T).M"). Defaults to false.
+func SetIncludeFramePackage(include bool) {
+	includeFramePackage.Store(include)
+}
+
+// packageName gets the package import path of a fully-qualified function name.
+func packageName(function string) string {
+	// Type parameters of generic functions can contain slashes of their own
+	if bracket := strings.IndexByte(function, '['); bracket >= 0 {
+		function = function[:bracket]
+	}
+	lastSlash := strings.LastIndexByte(function, '/')
+	dot := strings.IndexByte(function[lastSlash+1:], '.')
+	if dot < 0 {
+		return ""
+	}
+	return function[:lastSlash+1+dot]
+}
+
+// The JSON representation of a frame
+type jsonFrame struct {
+	Function string `json:"function"`
+	Package  string `json:"package,omitempty"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Repeat   int    `json:"repeat,omitempty"`
+}
+
+func (s Stack) MarshalJSON() ([]byte, error) {
+	return s.marshalFrames(nil)
+}
+
+// marshalFrames marshals the frames of the stack to JSON, where `repeats` is the
+// number of times each frame was repeated (see CollapsedStack), if it isn't nil.
+func (s Stack) marshalFrames(repeats []int) ([]byte, error) {
+	firstFrameIdx, lastFrameIdx := s.trimBounds()
+	jFrames := make([]jsonFrame, 0, lastFrameIdx-firstFrameIdx+1)
+	for i := firstFrameIdx; i <= lastFrameIdx; i++ {
+		jFrames = append(jFrames, jsonFrame{
+			Function: s[i].Function,
+			File:     outputFilePath(s[i].File),
+			Line:     s[i].Line,
+		})
+		if i < len(repeats) && repeats[i] > 1 {
+			jFrames[len(jFrames)-1].Repeat = repeats[i]
+		}
+		if includeFramePackage.Load() {
+			jFrames[len(jFrames)-1].Package = packageName(s[i].Function)
 		}
 	}
 	b, err := json.Marshal(jFrames)
@@ -78,17 +363,282 @@ func (s Stack) MarshalJSON() ([]byte, error) {
 	return b, nil
 }
 
-// Format formats the stack into a human-readable string
+// UnmarshalJSON unmarshals a stack from its JSON form. A frame that was repeated
+// (see CollapsedStack) is expanded into the number of frames it represents.
+func (s *Stack) UnmarshalJSON(data []byte) error {
+	c := CollapsedStack{}
+	if err := c.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	*s = c.Expand()
+	return nil
+}
+
+// The function used to shorten function names when formatting stacks
+var functionNameShortener atomic.Pointer[func(string) string]
+
+// SetFunctionNameShortener sets a function that is used to shorten function names
+// when formatting stacks in human-readable form (e.g. ShortFuncName). A nil
+// function leaves function names unchanged, which is the default.
+func SetFunctionNameShortener(shortener func(string) string) {
+	if shortener == nil {
+		functionNameShortener.Store(nil)
+		return
+	}
+	functionNameShortener.Store(&shortener)
+}
+
+// ShortFuncName shortens a function name by removing the package's path, e.g.
+// "github.com/org/repo/service.(*Server).Handle" becomes "service.(*Server).Handle".
+func ShortFuncName(function string) string {
+	// Type parameters may contain package paths too, so only look before them
+	end := strings.IndexByte(function, '[')
+	if end < 0 {
+		end = len(function)
+	}
+	return function[strings.LastIndexByte(function[:end], '/')+1:]
+}
+
+// Format formats the stack into a human-readable string.
 func (s Stack) Format() string {
-	res := ""
-	ts := s.trimStack()
-	for i, frame := range ts {
-		res = res + fmt.Sprintf("%s\n\t%s:%d", frame.Function, frame.File, frame.Line)
-		if i != len(ts)-1 {
-			res += "\n"
+	sb := &strings.Builder{}
+	s.writeFormatted(sb)
+	return sb.String()
+}
+
+// WriteTo writes the human-readable form of the stack (see Format) to a
+// writer, without building the entire output in memory first.
+func (s Stack) WriteTo(w io.Writer) (int64, error) {
+	return writeBuffered(w, s.writeFormatted)
+}
+
+// writeFormatted writes the human-readable form of the stack (see Format).
+func (s Stack) writeFormatted(w io.Writer) {
+	s.writeFormattedWith(w, "", nil, nil)
+}
+
+// writeFormattedWith writes the human-readable form of the stack (see Format),
+// with the label (if it isn't empty) in brackets on the first line, and the
+// number of times each frame was repeated (see CollapsedStack), if `repeats`
+// isn't nil. It calls `afterFrame` (if it isn't nil) after writing the
+// location of each frame.
+func (s Stack) writeFormattedWith(w io.Writer, label string, repeats []int, afterFrame func(w io.Writer, frame runtime.Frame)) {
+	firstFrameIdx, lastFrameIdx := s.trimBounds()
+	if label != "" {
+		io.WriteString(w, "["+label+"]\n")
+	}
+	for i := firstFrameIdx; i <= lastFrameIdx; i++ {
+		frame := s[i]
+		if frame.Function == truncatedFrameFunction && frame.File == "" {
+			io.WriteString(w, frame.Function)
+			if i != lastFrameIdx {
+				io.WriteString(w, "\n")
+			}
+			continue
+		}
+		file := outputFilePath(frame.File)
+		function := frame.Function
+		if shortener := functionNameShortener.Load(); shortener != nil {
+			function = (*shortener)(function)
+		}
+		if i < len(repeats) && repeats[i] > 1 {
+			fmt.Fprintf(w, "%s (x%d)\n\t%s:%d", function, repeats[i], file, frame.Line)
+		} else {
+			fmt.Fprintf(w, "%s\n\t%s:%d", function, file, frame.Line)
+		}
+		if afterFrame != nil {
+			afterFrame(w, frame)
+		}
+		if i != lastFrameIdx {
+			io.WriteString(w, "\n")
 		}
 	}
-	return res
+}
+
+// FormatWithSource formats the stack into a human-readable string (see Format), with
+// `contextLines` lines of source code before and after the line of each frame, if the
+// source file can be read (e.g. during local development). Only files under the `root`
+// directory (e.g. the module's directory) are read, since the stack may have been
+// parsed from untrusted input (see ParseStacks). Frames whose source files can't be
+// read are formatted without source code.
+func (s Stack) FormatWithSource(root string, contextLines int) string {
+	if contextLines < 0 {
+		contextLines = 0
+	}
+	root, rootErr := filepath.EvalSymlinks(root)
+	// Each file is only read once, even if multiple frames are in it
+	sources := map[string][]string{}
+	sb := &strings.Builder{}
+	s.writeFormattedWith(sb, "", nil, func(w io.Writer, frame runtime.Frame) {
+		lines, ok := sources[frame.File]
+		if !ok {
+			if rootErr == nil {
+				lines = readSourceLines(root, frame.File)
+			}
+			sources[frame.File] = lines
+		}
+		if frame.Line < 1 || frame.Line > len(lines) {
+			return
+		}
+		first := frame.Line - contextLines
+		if first < 1 {
+			first = 1
+		}
+		last := frame.Line + contextLines
+		if last > len(lines) {
+			last = len(lines)
+		}
+		for line := first; line <= last; line++ {
+			marker := " "
+			if line == frame.Line {
+				marker = ">"
+			}
+			fmt.Fprintf(w, "\n\t\t%s %5d | %s", marker, line, lines[line-1])
+		}
+	})
+	return sb.String()
+}
+
+// readSourceLines reads the lines of a source file, if it's under the root directory
+// (after resolving any symlinks).
+func readSourceLines(root string, file string) []string {
+	file, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return nil
+	}
+	rel, err := filepath.Rel(root, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")
+}
+
+// CollapsedStack is a stack where each run of identical consecutive frames (e.g.
+// from a recursive function) has been replaced by a single frame that is annotated
+// with the number of times it was repeated (see Stack.CollapseRecursion).
+type CollapsedStack struct {
+	Stack Stack
+	// The number of times each frame of the stack was repeated, by index
+	Repeats []int
+}
+
+// CollapseRecursion returns a copy of the stack where each run of identical
+// consecutive frames (e.g. from a recursive function) is replaced by a single
+// frame that is annotated with the number of times it was repeated.
+func (s Stack) CollapseRecursion() CollapsedStack {
+	collapsed := CollapsedStack{
+		Stack:   make(Stack, 0, len(s)),
+		Repeats: make([]int, 0, len(s)),
+	}
+	for i := 0; i < len(s); {
+		j := i + 1
+		for j < len(s) && s[j].Function == s[i].Function && s[j].File == s[i].File && s[j].Line == s[i].Line {
+			j++
+		}
+		collapsed.Stack = append(collapsed.Stack, s[i])
+		collapsed.Repeats = append(collapsed.Repeats, j-i)
+		i = j
+	}
+	return collapsed
+}
+
+// Expand returns the stack with each repeated frame expanded back into
+// the number of frames it represents.
+func (c CollapsedStack) Expand() Stack {
+	frames := make(Stack, 0, len(c.Stack))
+	for i, frame := range c.Stack {
+		frames = append(frames, frame)
+		for repeat := 1; i < len(c.Repeats) && repeat < c.Repeats[i]; repeat++ {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// Format formats the stack into a human-readable string (see Stack.Format),
+// where each repeated frame is annotated with its repeat count, e.g. "main.walk (x42)".
+func (c CollapsedStack) Format() string {
+	sb := &strings.Builder{}
+	c.Stack.writeFormattedWith(sb, "", c.Repeats, nil)
+	return sb.String()
+}
+
+// String formats the stack into a human-readable string, the same as Format.
+func (c CollapsedStack) String() string {
+	return c.Format()
+}
+
+// MarshalJSON marshals the stack to the same JSON form as a Stack, where each
+// repeated frame has a "repeat" field with its repeat count.
+func (c CollapsedStack) MarshalJSON() ([]byte, error) {
+	return c.Stack.marshalFrames(c.Repeats)
+}
+
+func (c *CollapsedStack) UnmarshalJSON(data []byte) error {
+	jFrames := []jsonFrame{}
+	if err := json.Unmarshal(data, &jFrames); err != nil {
+		return err
+	}
+	c.Stack = make(Stack, len(jFrames))
+	c.Repeats = make([]int, len(jFrames))
+	for i, jFrame := range jFrames {
+		c.Stack[i] = runtime.Frame{
+			Function: jFrame.Function,
+			File:     jFrame.File,
+			Line:     jFrame.Line,
+		}
+		c.Repeats[i] = 1
+		if jFrame.Repeat > 1 {
+			c.Repeats[i] = jFrame.Repeat
+		}
+	}
+	return nil
+}
+
+// Caller returns the frame that is `n` frames from the top (newest frame) of the
+// stack, ignoring any runtime frames that are trimmed when formatting. The
+// boolean is false if the stack doesn't have that many frames.
+func (s Stack) Caller(n int) (runtime.Frame, bool) {
+	ts := s.trimStack()
+	if n < 0 || n >= len(ts) {
+		return runtime.Frame{}, false
+	}
+	return ts[n], true
+}
+
+// Top returns the newest frame of the stack (where it originated), ignoring any
+// frames that are trimmed when formatting. The boolean is false if the stack is empty.
+func (s Stack) Top() (runtime.Frame, bool) {
+	return s.Caller(0)
+}
+
+// Bottom returns the oldest frame of the stack, ignoring any frames that are
+// trimmed when formatting. The boolean is false if the stack is empty.
+func (s Stack) Bottom() (runtime.Frame, bool) {
+	ts := s.trimStack()
+	if len(ts) == 0 {
+		return runtime.Frame{}, false
+	}
+	return ts[len(ts)-1], true
+}
+
+// String formats the stack into a human-readable string, the same as Format.
+func (s Stack) String() string {
+	return s.Format()
+}
+
+// GoString formats the stack into a compact string, with each frame in the
+// form "function@file:line", for use with the %#v verb.
+func (s Stack) GoString() string {
+	frames := make([]string, 0, len(s))
+	for _, frame := range s.trimStack() {
+		frames = append(frames, fmt.Sprintf("%s@%s:%d", frame.Function, frame.File, frame.Line))
+	}
+	return "stackerr.Stack{" + strings.Join(frames, ", ") + "}"
 }
 
 // FormatJson formats the stack into a JSON string
@@ -97,6 +647,56 @@ func (s Stack) FormatJson() string {
 	return string(b)
 }
 
+// FormatDelimited formats the stack into delimited text (e.g. CSV with ',' or TSV
+// with '\t') for spreadsheet analysis, with a header row and then one row per
+// frame, with function, file, and line columns. Values that contain the separator
+// are quoted. It returns an error if the separator can't be used as one (e.g. 0,
+// a quote, or a line break).
+func (s Stack) FormatDelimited(sep rune) (string, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Comma = sep
+	// The writer checks the separator when writing the first row
+	if err := w.Write([]string{"function", "file", "line"}); err != nil {
+		return "", fmt.Errorf("stackerr: invalid separator %q: %w", sep, err)
+	}
+	firstFrameIdx, lastFrameIdx := s.trimBounds()
+	for i := firstFrameIdx; i <= lastFrameIdx; i++ {
+		w.Write([]string{s[i].Function, outputFilePath(s[i].File), strconv.Itoa(s[i].Line)})
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+// Equal checks whether two stacks have the same frames (by function, file, and line),
+// ignoring any runtime frames that are trimmed when formatting.
+func (s Stack) Equal(other Stack) bool {
+	ts := s.trimStack()
+	to := other.trimStack()
+	if len(ts) != len(to) {
+		return false
+	}
+	for i, frame := range ts {
+		if frame.Function != to[i].Function || frame.File != to[i].File || frame.Line != to[i].Line {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal checks whether two sets of stacks have equal stacks, in the same order.
+func (s Stacks) Equal(other Stacks) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for i, stack := range s {
+		if !stack.Equal(other[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 // IsParentOf checks whether the stack is a parent of the child (i.e. whether the child's stack
 // trace entirely includes all frames of the parent's stack trace, and then possibly some more).
 func (parent Stack) IsParentOf(child Stack) bool {
@@ -124,33 +724,260 @@ func (parent Stack) IsParentOf(child Stack) bool {
 // RemoveParents removes all stacks from the set of stacks that is a parent of at least one other stack in the set of stacks.
 // This ensures that there are no stacks that contain information that is included in a different stack.
 func (s Stacks) RemoveParents() Stacks {
-	distinctStacks := Stacks{}
+	stacks, _ := pickStacks(s, nil, s.removeParentsIndices(nil))
+	return stacks
+}
+
+// removeParentsIndices gets the indices of the stacks that are kept by RemoveParents.
+// Stacks for which `skip` (if it isn't nil) returns true are always kept, and aren't
+// compared to other stacks.
+func (s Stacks) removeParentsIndices(skip func(i int) bool) []int {
+	kept := make([]int, 0, len(s))
 	// Stacks are ordered from newest to oldest.
 	// If a stack has a child stack that
 	// is older, it means it was wrapped in a calling
 	// function, which doesn't add any usefullness for us,
 	// so don't record that stack.
 	for i, stack := range s {
+		if skip != nil && skip(i) {
+			kept = append(kept, i)
+			continue
+		}
 		hasChild := false
 		for j := i + 1; j < len(s); j++ {
+			if skip != nil && skip(j) {
+				continue
+			}
 			if stack.IsParentOf(s[j]) {
 				hasChild = true
 				break
 			}
 		}
 		if !hasChild {
-			distinctStacks = append(distinctStacks, stack)
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
+
+// collapseSelfWrapsIndices gets the indices of the stacks that are kept when
+// collapsing runs of consecutive stacks that originate in the same function
+// (e.g. from a recursive function wrapping the error at each level) into a
+// single stack. The oldest stack of each run is kept, since it includes the
+// most frames of the recursion.
+func (s Stacks) collapseSelfWrapsIndices() []int {
+	kept := make([]int, 0, len(s))
+	for i, stack := range s {
+		if i+1 < len(s) {
+			ts := stack.trimStack()
+			next := s[i+1].trimStack()
+			if len(ts) > 0 && len(next) > 0 && ts[0].Function == next[0].Function {
+				continue
+			}
+		}
+		kept = append(kept, i)
+	}
+	return kept
+}
+
+// Prepend returns a new set of stacks with the given stack added as the newest
+// stack, and then any stacks that are parents of other stacks removed, unless
+// collapsing parent stacks is disabled (see SetCollapseParentStacks).
+func (s Stacks) Prepend(stack Stack) Stacks {
+	stacks := make(Stacks, 0, len(s)+1)
+	stacks = append(stacks, stack)
+	stacks = append(stacks, s...)
+	if !collapseParentStacks.Load() {
+		return stacks
+	}
+	return stacks.RemoveParents()
+}
+
+// Append returns a new set of stacks with the given stack added as the oldest
+// stack, and then any stacks that are parents of other stacks removed, unless
+// collapsing parent stacks is disabled (see SetCollapseParentStacks).
+func (s Stacks) Append(stack Stack) Stacks {
+	stacks := make(Stacks, 0, len(s)+1)
+	stacks = append(stacks, s...)
+	stacks = append(stacks, stack)
+	if !collapseParentStacks.Load() {
+		return stacks
+	}
+	return stacks.RemoveParents()
+}
+
+// OriginatesInFile checks whether the top (originating) frame of the newest
+// stack is in a file whose path contains `substr`.
+func (s Stacks) OriginatesInFile(substr string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	frame, ok := s[0].Caller(0)
+	return ok && strings.Contains(frame.File, substr)
+}
+
+// FirstAppFrame returns the newest frame that belongs to the application, i.e. whose
+// function name starts with one of the given module prefixes (e.g.
+// "github.com/org/app/"), skipping standard library and third-party frames. The
+// stacks are searched from newest to oldest. The boolean is false if no frame matches.
+func (s Stacks) FirstAppFrame(modulePrefixes ...string) (runtime.Frame, bool) {
+	for _, stack := range s {
+		for _, frame := range stack.trimStack() {
+			for _, prefix := range modulePrefixes {
+				if strings.HasPrefix(frame.Function, prefix) {
+					return frame, true
+				}
+			}
+		}
+	}
+	return runtime.Frame{}, false
+}
+
+// Map returns copies of the stacks with `transform` applied to every frame,
+// e.g. to rewrite file paths. The original stacks are not changed.
+func (s Stacks) Map(transform func(frame runtime.Frame) runtime.Frame) Stacks {
+	mapped := make(Stacks, len(s))
+	for i, stack := range s {
+		frames := make(Stack, len(stack))
+		for j, frame := range stack {
+			frames[j] = transform(frame)
+		}
+		mapped[i] = frames
+	}
+	return mapped
+}
+
+// The function name of the frame that marks where a stack was truncated
+const truncatedFrameFunction string = "...(truncated)"
+
+// Truncate returns a copy of the stack that is limited to its newest `n` frames
+// (ignoring any leading runtime frames that are trimmed when formatting). If any
+// frames were removed, a "...(truncated)" marker frame is appended. The stack is
+// returned unchanged if it doesn't have more than `n` frames.
+func (s Stack) Truncate(n int) Stack {
+	if n < 0 {
+		n = 0
+	}
+	firstFrameIdx, lastFrameIdx := s.trimBounds()
+	if lastFrameIdx-firstFrameIdx+1 <= n {
+		return s
+	}
+	frames := make(Stack, 0, n+1)
+	frames = append(frames, s[firstFrameIdx:firstFrameIdx+n]...)
+	return append(frames, runtime.Frame{
+		Function: truncatedFrameFunction,
+	})
+}
+
+// TruncateDepth returns copies of the stacks where each one is limited to its
+// newest `n` frames (see Stack.Truncate).
+func (s Stacks) TruncateDepth(n int) Stacks {
+	truncated := make(Stacks, len(s))
+	for i, stack := range s {
+		truncated[i] = stack.Truncate(n)
+	}
+	return truncated
+}
+
+// normalizeOptions are the options for normalizing stacks.
+type normalizeOptions struct {
+	zeroLines bool
+}
+
+// NormalizeOption is an option for Stacks.Normalize.
+type NormalizeOption func(o *normalizeOptions)
+
+// NormalizeZeroLines is an option for Stacks.Normalize that sets the line number
+// of every frame to 0, so that normalized stacks don't change when code is moved
+// within a file.
+func NormalizeZeroLines() NormalizeOption {
+	return func(o *normalizeOptions) {
+		o.zeroLines = true
+	}
+}
+
+// Normalize returns copies of the stacks that are suitable for stable comparisons
+// (e.g. in golden-file tests), where each frame's file path is replaced by its base
+// name. The options can normalize the frames further (e.g. NormalizeZeroLines).
+func (s Stacks) Normalize(opts ...NormalizeOption) Stacks {
+	var o normalizeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return s.Map(func(frame runtime.Frame) runtime.Frame {
+		if frame.File != "" {
+			frame.File = path.Base(strings.ReplaceAll(frame.File, "\\", "/"))
+		}
+		if o.zeroLines {
+			frame.Line = 0
+		}
+		return frame
+	})
+}
+
+// Filter returns the stacks for which `keep` returns true, in the same order.
+func (s Stacks) Filter(keep func(stack Stack) bool) Stacks {
+	filtered := make(Stacks, 0, len(s))
+	for _, stack := range s {
+		if keep(stack) {
+			filtered = append(filtered, stack)
 		}
 	}
-	return distinctStacks
+	return filtered
+}
+
+// GroupByOrigin groups the stacks by their originating (newest) frame, keyed by
+// "function@file:line" (see Stack.Top). Empty stacks are skipped. Within each
+// group, the stacks are in the same order as they were in the original set.
+func (s Stacks) GroupByOrigin() map[string]Stacks {
+	groups := map[string]Stacks{}
+	for _, stack := range s {
+		top, ok := stack.Top()
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%s@%s:%d", top.Function, top.File, top.Line)
+		groups[key] = append(groups[key], stack)
+	}
+	return groups
 }
 
 // Distinct removes any duplicate stacks.
 func (s Stacks) Distinct() Stacks {
+	stacks, _ := pickStacks(s, nil, s.distinctIndices(nil))
+	return stacks
+}
+
+// distinctIndices gets the indices of the stacks that are kept by Distinct,
+// with `skip` working as for removeParentsIndices.
+func (s Stacks) distinctIndices(skip func(i int) bool) []int {
+	kept := make([]int, 0, len(s))
+	m := map[string]struct{}{}
+	for i, stack := range s {
+		if skip != nil && skip(i) {
+			kept = append(kept, i)
+			continue
+		}
+		k := stack.Format()
+		if _, ok := m[k]; !ok {
+			kept = append(kept, i)
+			m[k] = struct{}{}
+		}
+	}
+	return kept
+}
+
+// DistinctByLocation removes any duplicate stacks, where stacks are considered
+// duplicates if their frames have the same files and lines, regardless of the
+// function names (e.g. the generated names of anonymous functions).
+func (s Stacks) DistinctByLocation() Stacks {
 	distinct := make(Stacks, 0, len(s))
 	m := map[string]struct{}{}
 	for _, stack := range s {
-		k := stack.Format()
+		k := ""
+		for _, frame := range stack.trimStack() {
+			k += fmt.Sprintf("%s:%d\n", frame.File, frame.Line)
+		}
 		if _, ok := m[k]; !ok {
 			distinct = append(distinct, stack)
 			m[k] = struct{}{}
@@ -159,19 +986,41 @@ func (s Stacks) Distinct() Stacks {
 	return distinct
 }
 
-// StackTrace gets the current stack
+// StackTrace gets the current stack. It returns nil if stack capture is
+// disabled (see SetStackCaptureEnabled).
 func StackTrace() Stack {
 	return StackTraceWithSkippedFrames(1)
 }
 
 // StackTraceWithSkippedFrames gets the current stack, with a certain number of frames skipped.
+// It returns nil if stack capture is disabled (see SetStackCaptureEnabled).
 func StackTraceWithSkippedFrames(skippedFrames int) Stack {
-	s := make([]uintptr, 1024)
+	if !stackCaptureEnabled.Load() {
+		return nil
+	}
+	buf := pcBufferPool.Get().(*[]uintptr)
+	defer pcBufferPool.Put(buf)
 
 	// runtime.Callers + this function
-	n := runtime.Callers(2+skippedFrames, s)
-	s = s[:n]
-	return uintptrToFrames(s)
+	n := runtime.Callers(2+skippedFrames, *buf)
+	return uintptrToFrames((*buf)[:n])
+}
+
+// The maximum number of frames in a captured stack
+const maxStackFrames int = 1024
+
+// A pool of program counter buffers for capturing stacks, since a buffer that's
+// large enough for the deepest stack is too large to allocate for every error
+var pcBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]uintptr, maxStackFrames)
+		return &buf
+	},
+}
+
+// StackFromPCs creates a Stack from program counters, e.g. as returned by runtime.Callers.
+func StackFromPCs(pcs []uintptr) Stack {
+	return uintptrToFrames(pcs)
 }
 
 func uintptrToFrames(stackPtrs []uintptr) Stack {
@@ -193,8 +1042,18 @@ func uintptrToFrames(stackPtrs []uintptr) Stack {
 }
 
 // ParseStacks parses a stack string into a Stacks struct. The input string
-// can be in human-readable (console) or JSON format.
+// can be in human-readable (console) or JSON format. There is no limit on the
+// size of the input; use ParseStacksWithLimit for untrusted input.
 func ParseStacks(s string) Stacks {
+	return ParseStacksWithLimit(s, 0)
+}
+
+// ParseStacksWithLimit is the same as ParseStacks, except that any block of
+// console-format input (stacks are separated by blank lines) that is longer than
+// maxBlockBytes is skipped instead of being parsed. This protects against
+// malformed input, such as a single multi-megabyte line, when parsing stacks
+// from untrusted sources. A maxBlockBytes of 0 or less means there is no limit.
+func ParseStacksWithLimit(s string, maxBlockBytes int) Stacks {
 	// Try parsing from JSON into stacks
 	stacks := Stacks{}
 	if err := json.Unmarshal([]byte(s), &stacks); err == nil {
@@ -207,21 +1066,97 @@ func ParseStacks(s string) Stacks {
 	// Try parsing it from console format
 	blocks := strings.Split(s, "\n\n")
 	for _, block := range blocks {
-		matches := consoleStackRegexp.FindAllStringSubmatch(block, -1)
-		if len(matches) == 0 {
+		if maxBlockBytes > 0 && len(block) > maxBlockBytes {
 			continue
 		}
-		stack := make(Stack, 0, len(matches))
-		for _, match := range matches {
-			line, _ := strconv.ParseInt(match[3], 10, 32)
-			stack = append(stack, runtime.Frame{
-				Function: match[1],
-				File:     match[2],
-				Line:     int(line),
-			})
-		}
-		stacks = append(stacks, stack)
+		stacks = append(stacks, parseBlock(block)...)
 	}
 
 	return stacks
 }
+
+// parseBlock parses the stacks in a block of console-format input.
+func parseBlock(block string) Stacks {
+	// Traces from testify have no function names, and would
+	// otherwise be misinterpreted as console format
+	if strings.Contains(block, testifyTracePrefix) {
+		return parseTestifyTraces(block)
+	}
+	matches := consoleStackRegexp.FindAllStringSubmatch(block, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	stack := make(Stack, 0, len(matches))
+	for _, match := range matches {
+		line, _ := strconv.ParseInt(match[3], 10, 32)
+		stack = append(stack, runtime.Frame{
+			Function: match[1],
+			File:     match[2],
+			Line:     int(line),
+		})
+	}
+	return Stacks{stack}
+}
+
+// The maximum length of a line that ParseStacksReader can parse
+const maxParseLineBytes int = 1024 * 1024
+
+// The maximum length of a block of lines (without a blank line) that ParseStacksReader can parse
+const maxParseBlockBytes int = 4 * 1024 * 1024
+
+// ParseStacksReader is the same as ParseStacks, except that it reads the input
+// from a reader. Console-format input is parsed incrementally, one block (stacks
+// are separated by blank lines) at a time, so the whole input doesn't need to fit
+// in memory (e.g. for large log files). Input that starts with '{' or '[' is
+// decoded as JSON directly from the reader. An error is returned if the input
+// can't be read, if it isn't valid JSON but starts like it, or if it has a line
+// longer than 1 MiB or a block longer than 4 MiB.
+func ParseStacksReader(r io.Reader) (Stacks, error) {
+	br := bufio.NewReader(r)
+	// Skip leading whitespace, to check whether it's JSON
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return Stacks{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+		br.UnreadByte()
+		if b == '{' || b == '[' {
+			stacks := Stacks{}
+			if err := json.NewDecoder(br).Decode(&stacks); err != nil {
+				return nil, fmt.Errorf("stackerr: failed to decode JSON stacks: %w", err)
+			}
+			return stacks, nil
+		}
+		break
+	}
+
+	stacks := Stacks{}
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxParseLineBytes)
+	block := &strings.Builder{}
+	for scanner.Scan() {
+		line := strings.ReplaceAll(scanner.Text(), "\r", "")
+		if line == "" {
+			stacks = append(stacks, parseBlock(block.String())...)
+			block.Reset()
+			continue
+		}
+		if block.Len()+len(line) >= maxParseBlockBytes {
+			return nil, fmt.Errorf("stackerr: block of lines without a blank line is longer than %d bytes", maxParseBlockBytes)
+		}
+		if block.Len() > 0 {
+			block.WriteByte('\n')
+		}
+		block.WriteString(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	stacks = append(stacks, parseBlock(block.String())...)
+	return stacks, nil
+}
@@ -0,0 +1,127 @@
+package stackerr
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// stackMeta is optional metadata that is associated with one of an error's stacks.
+type stackMeta struct {
+	// The time the stack was captured at (see SetCaptureStackTimestamps)
+	CapturedAt time.Time
+	// The label of the layer where the stack was captured (see WrapLabeled)
+	Label string
+	// The ID of the stack in the stack store, if it was offloaded to it (see
+	// SetStackStore), in which case the error doesn't keep the stack's frames
+	StoreID string
+}
+
+// stackMetas is the metadata of a set of stacks, in the same order as the stacks.
+// It's nil if none of the stacks have metadata.
+type stackMetas []stackMeta
+
+// at gets the metadata of the stack at index `i`.
+func (m stackMetas) at(i int) stackMeta {
+	if i < 0 || i >= len(m) {
+		return stackMeta{}
+	}
+	return m[i]
+}
+
+// set returns the metadata of a set of `n` stacks, where the stack at index `i`
+// has the given metadata. The metadata is allocated if it's nil, so `m` may be changed.
+func (m stackMetas) set(n int, i int, meta stackMeta) stackMetas {
+	if m == nil {
+		if meta == (stackMeta{}) {
+			return nil
+		}
+		m = make(stackMetas, n)
+	}
+	m[i] = meta
+	return m
+}
+
+// pickStacks gets the stacks at the given indices, with their metadata.
+func pickStacks(stacks Stacks, metas stackMetas, indices []int) (Stacks, stackMetas) {
+	picked := make(Stacks, len(indices))
+	var pickedMetas stackMetas
+	for i, idx := range indices {
+		picked[i] = stacks[idx]
+		pickedMetas = pickedMetas.set(len(indices), i, metas.at(idx))
+	}
+	return picked, pickedMetas
+}
+
+// concatStacks concatenates sets of stacks, and their metadata.
+func concatStacks(stacks Stacks, metas stackMetas, more Stacks, moreMetas stackMetas) (Stacks, stackMetas) {
+	all := make(Stacks, 0, len(stacks)+len(more))
+	all = append(append(all, stacks...), more...)
+	if metas == nil && moreMetas == nil {
+		return all, nil
+	}
+	allMetas := make(stackMetas, len(all))
+	for i := range stacks {
+		allMetas[i] = metas.at(i)
+	}
+	for i := range more {
+		allMetas[len(stacks)+i] = moreMetas.at(i)
+	}
+	return all, allMetas
+}
+
+// isStored checks whether the stack at index `i` was offloaded to the stack store,
+// so its frames aren't available.
+func (m stackMetas) isStored(i int) bool {
+	return m.at(i).StoreID != ""
+}
+
+// removeParentStacks is the same as Stacks.RemoveParents, for a set of stacks and their
+// metadata. Offloaded stacks are always kept.
+func removeParentStacks(stacks Stacks, metas stackMetas) (Stacks, stackMetas) {
+	var skip func(i int) bool
+	if metas != nil {
+		skip = metas.isStored
+	}
+	return pickStacks(stacks, metas, stacks.removeParentsIndices(skip))
+}
+
+// slice gets the metadata of the stacks from index `i` up to (but not including) index `j`.
+func (m stackMetas) slice(i, j int) stackMetas {
+	if m == nil {
+		return nil
+	}
+	return m[i:j]
+}
+
+// distinctStacks is the same as removeParentStacks, but for Stacks.Distinct.
+func distinctStacks(stacks Stacks, metas stackMetas) (Stacks, stackMetas) {
+	var skip func(i int) bool
+	if metas != nil {
+		skip = metas.isStored
+	}
+	return pickStacks(stacks, metas, stacks.distinctIndices(skip))
+}
+
+// Whether stacks should record the time they were captured at
+var captureStackTimestamps atomic.Bool
+
+// SetCaptureStackTimestamps sets whether newly captured stacks should record
+// the wall-clock time at which they were captured (see Error.StackCapturedAt).
+// Defaults to false, since getting the current time on every capture has a cost.
+func SetCaptureStackTimestamps(capture bool) {
+	captureStackTimestamps.Store(capture)
+}
+
+// captureStack captures the current stack for a new error, with a certain number
+// of frames skipped, along with its metadata. Every stack that is captured for an
+// error goes through here. The stack is nil if stack capture is disabled (see
+// SetStackCaptureEnabled).
+func captureStack(skippedFrames int) (Stack, stackMeta) {
+	stack := StackTraceWithSkippedFrames(1 + skippedFrames)
+	if stack == nil || !captureStackTimestamps.Load() {
+		return stack, stackMeta{}
+	}
+	return stack, stackMeta{
+		CapturedAt: time.Now(),
+	}
+}
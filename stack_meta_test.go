@@ -0,0 +1,97 @@
+package stackerr
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStackCapturedAt(t *testing.T) {
+	defer SetCaptureStackTimestamps(false)
+	SetCaptureStackTimestamps(true)
+
+	inner := Wrap(errors.New("broken pipe"))
+	time.Sleep(10 * time.Millisecond)
+	outer := WrapKeepingAllStacks(inner)
+
+	times := outer.StackCapturedAt()
+	if len(times) != 2 {
+		t.Fatalf("expected 2 capture times, got %d", len(times))
+	}
+	if times[0].IsZero() || times[1].IsZero() {
+		t.Fatal("expected both stacks to have a capture time")
+	}
+	if !times[0].After(times[1]) {
+		t.Fatalf("expected the outer stack to be captured after the inner stack, got %v and %v", times[0], times[1])
+	}
+
+	// The capture times survive copies and a JSON round trip
+	if !outer.WithSingle("key", "value").StackCapturedAt()[1].Equal(times[1]) {
+		t.Fatal("expected the capture time to be kept by With")
+	}
+	b, err := json.Marshal(outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshaled, err := UnmarshalError(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, capturedAt := range unmarshaled.StackCapturedAt() {
+		if !capturedAt.Equal(times[i]) {
+			t.Fatalf("expected capture time %v for stack %d, got %v", times[i], i, capturedAt)
+		}
+	}
+}
+
+func TestStackCapturedAtDisabled(t *testing.T) {
+	err := Wrap(errors.New("connection refused"))
+	if times := err.StackCapturedAt(); len(times) != 1 || !times[0].IsZero() {
+		t.Fatalf("expected a zero capture time, got %v", times)
+	}
+	b, _ := json.Marshal(err)
+	if raw := map[string]any{}; json.Unmarshal(b, &raw) == nil && raw["stack_captured_at"] != nil {
+		t.Fatal("expected no capture times in the JSON form")
+	}
+}
+
+// wrapLabeledInHelper wraps an error with a label in a function other than the caller
+func wrapLabeledInHelper(label string, err error) Error {
+	return WrapLabeled(label, err)
+}
+
+func TestWrapLabeledLayers(t *testing.T) {
+	// The outer labeled stack is a parent of the inner one, but both are kept
+	inner := wrapLabeledInHelper("repository", errors.New("record not found"))
+	outer := WrapLabeled("handler", inner)
+
+	labels := outer.StackLabels()
+	if len(labels) != 2 || labels[0] != "handler" || labels[1] != "repository" {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	formatted := outer.FormatStacks()
+	if !strings.Contains(formatted, "[handler]") || !strings.Contains(formatted, "[repository]") {
+		t.Fatalf("expected both labels to be formatted, got %q", formatted)
+	}
+
+	b, err := json.Marshal(outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := struct {
+		StackLabels []string `json:"stack_labels"`
+	}{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.StackLabels) != 2 || raw.StackLabels[0] != "handler" || raw.StackLabels[1] != "repository" {
+		t.Fatalf("unexpected JSON labels %v", raw.StackLabels)
+	}
+
+	// A collapsing wrap still removes the labeled stacks that are its parents
+	if n := len(Wrap(outer).Stacks()); n != 1 {
+		t.Fatalf("expected the labeled stacks to be collapsed, got %d stacks", n)
+	}
+}
@@ -0,0 +1,109 @@
+package stackerr
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync/atomic"
+)
+
+// StackStore is an external store for stacks, so that errors only need to keep
+// a reference to their stacks in memory (see SetStackStore).
+type StackStore interface {
+	// Put stores a stack with the given ID.
+	Put(id string, s Stack) error
+	// Get retrieves the stack with the given ID.
+	Get(id string) (Stack, error)
+}
+
+// The store that newly captured stacks are offloaded to
+var stackStore atomic.Pointer[StackStore]
+
+// SetStackStore sets a store that the stacks of new errors are offloaded to, so that
+// errors only keep a reference to them. The stacks are retrieved from the store
+// when they're needed (e.g. by Stacks, FormatStacks, or MarshalJSON). If a stack
+// can't be stored, it's kept in the error instead, and if it can't be retrieved
+// (e.g. the store was removed), it's empty. Since the frames of offloaded stacks
+// aren't available when wrapping, they're never removed for being the parent of
+// another stack (see SetCollapseParentStacks). A nil store (the default) disables
+// offloading.
+func SetStackStore(store StackStore) {
+	if store == nil {
+		stackStore.Store(nil)
+		return
+	}
+	stackStore.Store(&store)
+}
+
+// loadStackStore gets the stack store, or nil if there isn't one.
+func loadStackStore() StackStore {
+	if store := stackStore.Load(); store != nil {
+		return *store
+	}
+	return nil
+}
+
+// offloadStack puts a stack in the stack store, if there is one. If it was stored,
+// the stack that should be kept in the error is nil, and its metadata refers to the
+// stored stack. If there's no store or the stack can't be stored, the stack and
+// metadata are returned unchanged.
+func offloadStack(s Stack, m stackMeta) (Stack, stackMeta) {
+	store := loadStackStore()
+	if store == nil || len(s) == 0 {
+		return s, m
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return s, m
+	}
+	id := hex.EncodeToString(b)
+	if err := store.Put(id, s); err != nil {
+		return s, m
+	}
+	m.StoreID = id
+	return nil, m
+}
+
+// retrieveStack gets a stack that was offloaded to the stack store. The
+// boolean is false if there's no store or the stack can't be retrieved.
+func retrieveStack(m stackMeta) (Stack, bool) {
+	store := loadStackStore()
+	if store == nil {
+		return nil, false
+	}
+	stored, err := store.Get(m.StoreID)
+	if err != nil {
+		return nil, false
+	}
+	return stored, true
+}
+
+// resolveStacks gets a set of stacks where any stacks that were offloaded to the stack
+// store (according to their metadata) are retrieved from it. Stacks that can't be
+// retrieved are empty. If no stacks were offloaded, the stacks are returned unchanged.
+func resolveStacks(stacks Stacks, metas stackMetas) Stacks {
+	var resolved Stacks
+	for i := range stacks {
+		m := metas.at(i)
+		if m.StoreID == "" {
+			continue
+		}
+		if resolved == nil {
+			resolved = make(Stacks, len(stacks))
+			copy(resolved, stacks)
+		}
+		resolved[i], _ = retrieveStack(m)
+		if resolved[i] == nil {
+			resolved[i] = Stack{}
+		}
+	}
+	if resolved == nil {
+		return stacks
+	}
+	return resolved
+}
+
+// resolvedStacks gets the error's stacks, with any stacks that were
+// offloaded to the stack store retrieved from it (see resolveStacks).
+func (se *stackError) resolvedStacks() Stacks {
+	return resolveStacks(se.StackTraces, se.StackMetas)
+}
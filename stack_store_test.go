@@ -0,0 +1,142 @@
+package stackerr
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memoryStackStore is an in-memory StackStore that counts its calls
+type memoryStackStore struct {
+	mu     sync.Mutex
+	stacks map[string]Stack
+	gets   int
+	// Whether Get fails
+	failGet bool
+}
+
+func newMemoryStackStore() *memoryStackStore {
+	return &memoryStackStore{
+		stacks: map[string]Stack{},
+	}
+}
+
+func (s *memoryStackStore) Put(id string, stack Stack) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stacks[id] = stack
+	return nil
+}
+
+func (s *memoryStackStore) Get(id string) (Stack, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	stack, ok := s.stacks[id]
+	if !ok || s.failGet {
+		return nil, errors.New("stack not found")
+	}
+	return stack, nil
+}
+
+// useStackStore sets a new in-memory stack store for the duration of a test
+func useStackStore(t *testing.T) *memoryStackStore {
+	store := newMemoryStackStore()
+	SetStackStore(store)
+	t.Cleanup(func() {
+		SetStackStore(nil)
+	})
+	return store
+}
+
+// assertOffloaded checks that all of an error's stacks were offloaded to the store
+func assertOffloaded(t *testing.T, err Error, count int) {
+	t.Helper()
+	se := err.(*stackError)
+	if len(se.StackTraces) != count {
+		t.Fatalf("expected %d stacks, got %d", count, len(se.StackTraces))
+	}
+	for i, stack := range se.StackTraces {
+		if stack != nil || !se.StackMetas.isStored(i) {
+			t.Fatalf("expected stack %d to be offloaded", i)
+		}
+	}
+}
+
+func TestStackStoreOffloadsAndRetrieves(t *testing.T) {
+	store := useStackStore(t)
+	err := Wrap(errors.New("permission denied"))
+	assertOffloaded(t, err, 1)
+	if len(store.stacks) != 1 || store.gets != 0 {
+		t.Fatalf("expected 1 stored stack and no retrievals, got %d and %d", len(store.stacks), store.gets)
+	}
+
+	formatted := err.FormatStacks()
+	if store.gets != 1 {
+		t.Fatalf("expected the stack to be retrieved once, got %d", store.gets)
+	}
+	if !strings.Contains(formatted, "TestStackStoreOffloadsAndRetrieves") {
+		t.Fatalf("expected the retrieved stack to be formatted, got %q", formatted)
+	}
+	if strings.Contains(formatted, "stackRef") {
+		t.Fatalf("expected no reference frames, got %q", formatted)
+	}
+	if top, ok := err.Stacks()[0].Top(); !ok || !strings.HasSuffix(top.Function, "TestStackStoreOffloadsAndRetrieves") {
+		t.Fatalf("unexpected top frame %v", top)
+	}
+}
+
+func TestStackStoreCoversAllCapturePaths(t *testing.T) {
+	useStackStore(t)
+	base := errors.New("lock timeout")
+	assertOffloaded(t, ReStack(base), 1)
+	assertOffloaded(t, GoWrap(StackTrace(), base), 2)
+	assertOffloaded(t, WrapFrom(TestStackStoreCoversAllCapturePaths, base), 1)
+	assertOffloaded(t, WrapLabeled("handler", base), 1)
+	assertOffloaded(t, WrapWithStack(base, StackTrace()), 1)
+}
+
+func TestStackStoreKeepsMetadata(t *testing.T) {
+	useStackStore(t)
+	defer SetCaptureStackTimestamps(false)
+	SetCaptureStackTimestamps(true)
+
+	err := WrapLabeled("handler", errors.New("invalid input"))
+	if labels := err.StackLabels(); len(labels) != 1 || labels[0] != "handler" {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	if err.StackCapturedAt()[0].IsZero() {
+		t.Fatal("expected a capture time")
+	}
+	if !strings.Contains(err.FormatStacks(), "[handler]") {
+		t.Fatal("expected the label to be formatted")
+	}
+}
+
+func TestStackStoreUnavailable(t *testing.T) {
+	store := useStackStore(t)
+	err := Wrap(errors.New("disk full"))
+
+	store.failGet = true
+	if stacks := err.Stacks(); len(stacks) != 1 || len(stacks[0]) != 0 {
+		t.Fatalf("expected 1 empty stack, got %v", stacks)
+	}
+
+	SetStackStore(nil)
+	if formatted := err.FormatStacks(); strings.Contains(formatted, "stackRef") || strings.Count(formatted, "\n") != 2 {
+		t.Fatalf("expected an empty stack, got %q", formatted)
+	}
+	if _, jerr := err.MarshalJSON(); jerr != nil {
+		t.Fatal(jerr)
+	}
+}
+
+func TestStackStoreParentsAreKept(t *testing.T) {
+	useStackStore(t)
+	err := wrapInHelper(Wrap(errors.New("upstream unavailable")))
+	// Offloaded stacks aren't removed for being parents, since their frames aren't available
+	if n := len(err.Stacks()); n != 2 {
+		t.Fatalf("expected 2 stacks, got %d", n)
+	}
+}
@@ -0,0 +1,820 @@
+package stackerr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// A stack, and a stack that is its parent
+var (
+	childStack = Stack{
+		{Function: "pkg.inner", File: "inner.go", Line: 5},
+		{Function: "main.main", File: "main.go", Line: 10},
+	}
+	parentStack = Stack{
+		{Function: "main.main", File: "main.go", Line: 12},
+	}
+	otherStack = Stack{
+		{Function: "pkg.other", File: "other.go", Line: 7},
+	}
+)
+
+func TestStacksPrependAndAppend(t *testing.T) {
+	stacks := Stacks{childStack}
+	if prepended := stacks.Prepend(otherStack); !reflect.DeepEqual(prepended, Stacks{otherStack, childStack}) {
+		t.Fatalf("expected the stack to be added as the newest, got %v", prepended)
+	}
+	if appended := stacks.Append(otherStack); !reflect.DeepEqual(appended, Stacks{childStack, otherStack}) {
+		t.Fatalf("expected the stack to be added as the oldest, got %v", appended)
+	}
+	if len(stacks) != 1 {
+		t.Fatal("expected the original stacks not to be changed")
+	}
+
+	// Parents are removed
+	if prepended := stacks.Prepend(parentStack); !reflect.DeepEqual(prepended, Stacks{childStack}) {
+		t.Fatalf("expected the parent to be removed, got %v", prepended)
+	}
+	if appended := (Stacks{parentStack}).Append(childStack); !reflect.DeepEqual(appended, Stacks{childStack}) {
+		t.Fatalf("expected the parent to be removed, got %v", appended)
+	}
+
+	// Unless collapsing parent stacks is disabled
+	defer SetCollapseParentStacks(true)
+	SetCollapseParentStacks(false)
+	if prepended := stacks.Prepend(parentStack); !reflect.DeepEqual(prepended, Stacks{parentStack, childStack}) {
+		t.Fatalf("expected the parent to be kept, got %v", prepended)
+	}
+	if appended := (Stacks{parentStack}).Append(childStack); !reflect.DeepEqual(appended, Stacks{parentStack, childStack}) {
+		t.Fatalf("expected the parent to be kept, got %v", appended)
+	}
+}
+
+func TestStacksNormalize(t *testing.T) {
+	// The same stacks captured under different path prefixes
+	onLinux := Stacks{{
+		{Function: "pkg.inner", File: "/home/ci/src/pkg/inner.go", Line: 5},
+		{Function: "main.main", File: "/home/ci/src/main.go", Line: 10},
+	}}
+	onWindows := Stacks{{
+		{Function: "pkg.inner", File: `C:\Users\dev\src\pkg\inner.go`, Line: 5},
+		{Function: "main.main", File: `C:\Users\dev\src\main.go`, Line: 10},
+	}}
+	normalized := onLinux.Normalize()
+	if !reflect.DeepEqual(normalized, onWindows.Normalize()) {
+		t.Fatalf("expected identical stacks, got %v and %v", normalized, onWindows.Normalize())
+	}
+	if normalized[0][0].File != "inner.go" || normalized[0][0].Line != 5 {
+		t.Fatalf("unexpected frame %v", normalized[0][0])
+	}
+	if onLinux[0][0].File != "/home/ci/src/pkg/inner.go" {
+		t.Fatal("expected the original stacks not to be changed")
+	}
+
+	// Line numbers are only zeroed with the option
+	zeroed := onLinux.Normalize(NormalizeZeroLines())
+	for _, frame := range zeroed[0] {
+		if frame.Line != 0 {
+			t.Fatalf("expected a zero line number, got %v", frame)
+		}
+	}
+	if onLinux.Normalize()[0][0].Line != 5 {
+		t.Fatal("expected the option not to affect other calls")
+	}
+
+	err := WrapWithStacks(errors.New("token expired"), onLinux)
+	if err.FormatStacksNormalized() != WrapWithStacks(errors.New("token expired"), onWindows).FormatStacksNormalized() {
+		t.Fatal("expected identical formatted stacks")
+	}
+	if formatted := err.FormatStacksNormalized(NormalizeZeroLines()); !strings.Contains(formatted, "inner.go:0") {
+		t.Fatalf("expected zeroed line numbers, got %q", formatted)
+	}
+}
+
+func TestTrimStack(t *testing.T) {
+	stack := Stack{
+		{Function: "runtime.Callers", File: "/go/src/runtime/extern.go", Line: 331},
+		{Function: "github.com/Invicton-Labs/go-stackerr.StackTraceWithSkippedFrames", File: "/src/go-stackerr/stack.go", Line: 40},
+		{Function: "main.handle", File: "/src/app/main.go", Line: 8},
+		{Function: "main.main", File: "/src/app/main.go", Line: 3},
+		{Function: "runtime.main", File: "/go/src/runtime/proc.go", Line: 250},
+		{Function: "runtime.goexit", File: "/go/src/runtime/asm_amd64.s", Line: 1650},
+	}
+	if trimmed := stack.trimStack(); len(trimmed) != 3 || trimmed[0].Function != packageFunctionPrefix+"StackTraceWithSkippedFrames" || trimmed[2].Function != "main.main" {
+		t.Fatalf("expected only the runtime frames to be trimmed, got %v", trimmed)
+	}
+
+	defer SetTrimInternalFrames(false)
+	SetTrimInternalFrames(true)
+	if trimmed := stack.trimStack(); len(trimmed) != 2 || trimmed[0].Function != "main.handle" {
+		t.Fatalf("expected the internal frames to be trimmed, got %v", trimmed)
+	}
+	if formatted := stack.Format(); strings.Contains(formatted, "runtime.") || strings.Contains(formatted, packageFunctionPrefix) {
+		t.Fatalf("expected no runtime or internal frames, got %q", formatted)
+	}
+
+	// A captured stack starts in the caller and ends in user code
+	defer SetTrimTestFrames(false)
+	SetTrimTestFrames(true)
+	captured := Wrap(errors.New("bad gateway")).Stacks()[0].trimStack()
+	if len(captured) == 0 || captured[0].Function != packageFunctionPrefix+"TestTrimStack" {
+		t.Fatalf("expected the test to be the top frame, got %v", captured)
+	}
+	for _, frame := range []runtime.Frame{captured[0], captured[len(captured)-1]} {
+		if strings.HasPrefix(frame.Function, "runtime.") || strings.HasPrefix(frame.Function, "testing.") {
+			t.Fatalf("expected no runtime or testing frames at either end, got %v", captured)
+		}
+	}
+}
+
+func TestStackEqual(t *testing.T) {
+	copied := append(Stack{}, childStack...)
+	if !childStack.Equal(copied) || !(Stacks{childStack, otherStack}).Equal(Stacks{copied, otherStack}) {
+		t.Fatal("expected equal stacks")
+	}
+	// Trimmed runtime frames are ignored
+	withRuntime := append(append(Stack{}, childStack...), runtime.Frame{Function: "runtime.goexit", File: "asm_amd64.s", Line: 1650})
+	if !childStack.Equal(withRuntime) {
+		t.Fatal("expected trimmed frames to be ignored")
+	}
+
+	differentLine := append(Stack{}, childStack...)
+	differentLine[0].Line++
+	if childStack.Equal(differentLine) || (Stacks{childStack}).Equal(Stacks{differentLine}) {
+		t.Fatal("expected stacks that differ by line not to be equal")
+	}
+	if childStack.Equal(childStack[:1]) || (Stacks{childStack}).Equal(Stacks{childStack, otherStack}) {
+		t.Fatal("expected stacks of different lengths not to be equal")
+	}
+	if (Stacks{childStack, otherStack}).Equal(Stacks{otherStack, childStack}) {
+		t.Fatal("expected stacks in a different order not to be equal")
+	}
+}
+
+// recursiveStack is a synthetic stack of a function that called itself `depth` times
+func recursiveStack(depth int) Stack {
+	stack := Stack{{Function: "main.leaf", File: "main.go", Line: 20}}
+	for i := 0; i < depth; i++ {
+		stack = append(stack, runtime.Frame{Function: "main.walk", File: "main.go", Line: 12})
+	}
+	return append(stack, runtime.Frame{Function: "main.main", File: "main.go", Line: 3})
+}
+
+func TestCollapseRecursion(t *testing.T) {
+	stack := recursiveStack(42)
+	collapsed := stack.CollapseRecursion()
+	if len(collapsed.Stack) != 3 || !reflect.DeepEqual(collapsed.Repeats, []int{1, 42, 1}) {
+		t.Fatalf("expected 3 frames with repeats [1 42 1], got %v and %v", collapsed.Stack, collapsed.Repeats)
+	}
+	if !collapsed.Expand().Equal(stack) || len(collapsed.Expand()) != len(stack) {
+		t.Fatal("expected the expanded stack to match the original")
+	}
+	if formatted := collapsed.Format(); !strings.Contains(formatted, "main.walk (x42)") || strings.Count(formatted, "main.walk") != 1 {
+		t.Fatalf("expected the repeat annotation, got %q", formatted)
+	}
+
+	b, err := json.Marshal(collapsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := []struct {
+		Function string `json:"function"`
+		Repeat   int    `json:"repeat"`
+	}{}
+	if err := json.Unmarshal(b, &frames); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 || frames[1].Function != "main.walk" || frames[1].Repeat != 42 || frames[0].Repeat != 0 {
+		t.Fatalf("expected a repeat count on the recursive frame only, got %s", b)
+	}
+
+	// The JSON form round trips, and a Stack expands the repeated frames
+	unmarshaled := CollapsedStack{}
+	if err := json.Unmarshal(b, &unmarshaled); err != nil || !reflect.DeepEqual(unmarshaled.Repeats, collapsed.Repeats) {
+		t.Fatalf("expected the repeats to round trip, got %v (%v)", unmarshaled.Repeats, err)
+	}
+	expanded := Stack{}
+	if err := json.Unmarshal(b, &expanded); err != nil || !expanded.Equal(stack) {
+		t.Fatalf("expected the stack to be expanded, got %v (%v)", expanded, err)
+	}
+}
+
+func TestStacksFilter(t *testing.T) {
+	stacks := Stacks{childStack, otherStack, parentStack}
+	inMain := stacks.Filter(func(stack Stack) bool {
+		for _, frame := range stack {
+			if strings.HasPrefix(frame.Function, "main.") {
+				return true
+			}
+		}
+		return false
+	})
+	if !reflect.DeepEqual(inMain, Stacks{childStack, parentStack}) {
+		t.Fatalf("expected the stacks through main in order, got %v", inMain)
+	}
+	if none := stacks.Filter(func(Stack) bool { return false }); none == nil || len(none) != 0 {
+		t.Fatalf("expected an empty set of stacks, got %v", none)
+	}
+	if len(stacks) != 3 {
+		t.Fatal("expected the original stacks not to be changed")
+	}
+}
+
+func TestStackCaller(t *testing.T) {
+	stack := append(Stack{{Function: "runtime.Callers", File: "extern.go", Line: 331}}, childStack...)
+	for n, function := range []string{"pkg.inner", "main.main"} {
+		if frame, ok := stack.Caller(n); !ok || frame.Function != function {
+			t.Fatalf("expected frame %d to be %s, got %v", n, function, frame)
+		}
+	}
+	for _, n := range []int{-1, 2} {
+		if frame, ok := stack.Caller(n); ok || frame != (runtime.Frame{}) {
+			t.Fatalf("expected no frame %d, got %v", n, frame)
+		}
+	}
+	if _, ok := (Stack{}).Caller(0); ok {
+		t.Fatal("expected no frame in an empty stack")
+	}
+}
+
+func TestFunctionNameShortener(t *testing.T) {
+	stack := Stack{{Function: "github.com/myorg/myrepo/internal/service.(*Server).HandleRequest", File: "server.go", Line: 9}}
+	if formatted := stack.Format(); formatted != "github.com/myorg/myrepo/internal/service.(*Server).HandleRequest\n\tserver.go:9" {
+		t.Fatalf("expected the full name by default, got %q", formatted)
+	}
+
+	defer SetFunctionNameShortener(nil)
+	SetFunctionNameShortener(ShortFuncName)
+	if formatted := stack.Format(); formatted != "service.(*Server).HandleRequest\n\tserver.go:9" {
+		t.Fatalf("expected the short name, got %q", formatted)
+	}
+	SetFunctionNameShortener(strings.ToUpper)
+	if formatted := stack.Format(); !strings.HasPrefix(formatted, "GITHUB.COM/MYORG/") {
+		t.Fatalf("expected the custom shortener to be used, got %q", formatted)
+	}
+
+	if short := ShortFuncName("main.run[...]"); short != "main.run[...]" {
+		t.Fatalf("unexpected short name %q", short)
+	}
+	if short := ShortFuncName("example.com/pkg.Map[example.com/other.T]"); short != "pkg.Map[example.com/other.T]" {
+		t.Fatalf("expected type parameters to be kept, got %q", short)
+	}
+}
+
+func TestNormalizePathSeparators(t *testing.T) {
+	stack := Stack{{Function: "main.main", File: `C:\Users\dev\app\main.go`, Line: 3}}
+	if formatted := stack.Format(); formatted != "main.main\n\tC:\\Users\\dev\\app\\main.go:3" {
+		t.Fatalf("expected the raw path by default, got %q", formatted)
+	}
+	if b, _ := json.Marshal(stack); !strings.Contains(string(b), `"C:\\Users\\dev\\app\\main.go"`) {
+		t.Fatalf("expected the raw path by default, got %s", b)
+	}
+
+	defer SetNormalizePathSeparators(false)
+	SetNormalizePathSeparators(true)
+	if formatted := stack.Format(); formatted != "main.main\n\tC:/Users/dev/app/main.go:3" {
+		t.Fatalf("expected a normalized path, got %q", formatted)
+	}
+	if b, _ := json.Marshal(stack); !strings.Contains(string(b), `"C:/Users/dev/app/main.go"`) {
+		t.Fatalf("expected a normalized path, got %s", b)
+	}
+	if stack[0].File != `C:\Users\dev\app\main.go` {
+		t.Fatal("expected the stack not to be changed")
+	}
+}
+
+func TestStacksJSON(t *testing.T) {
+	stacks := Stacks{childStack, otherStack}
+	b, err := json.Marshal(stacks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shape := struct {
+		Count  int               `json:"count"`
+		Stacks []json.RawMessage `json:"stacks"`
+	}{}
+	if err := json.Unmarshal(b, &shape); err != nil || shape.Count != 2 || len(shape.Stacks) != 2 {
+		t.Fatalf("expected an object with a count of 2, got %s", b)
+	}
+	if b, _ := json.Marshal(Stacks(nil)); string(b) != `{"count":0,"stacks":[]}` {
+		t.Fatalf("unexpected JSON for no stacks: %s", b)
+	}
+
+	// Both the object form and a bare array can be unmarshaled
+	array, err := json.Marshal([]Stack(stacks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"object": b, "array": array} {
+		unmarshaled := Stacks{}
+		if err := json.Unmarshal(data, &unmarshaled); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !unmarshaled.Equal(stacks) {
+			t.Fatalf("%s: expected %v, got %v", name, stacks, unmarshaled)
+		}
+	}
+}
+
+func TestStackStringAndGoString(t *testing.T) {
+	if fmt.Sprint(childStack) != childStack.Format() {
+		t.Fatalf("expected fmt.Sprint to match Format, got %q", fmt.Sprint(childStack))
+	}
+	stacks := Stacks{childStack, otherStack}
+	if fmt.Sprint(stacks) != stacks.Format() {
+		t.Fatalf("expected fmt.Sprint to match Format, got %q", fmt.Sprint(stacks))
+	}
+	if s := fmt.Sprintf("%#v", childStack); s != "stackerr.Stack{pkg.inner@inner.go:5, main.main@main.go:10}" {
+		t.Fatalf("unexpected compact form %q", s)
+	}
+	if s := fmt.Sprintf("%#v", stacks); s != "stackerr.Stacks{stackerr.Stack{pkg.inner@inner.go:5, main.main@main.go:10}, stackerr.Stack{pkg.other@other.go:7}}" {
+		t.Fatalf("unexpected compact form %q", s)
+	}
+}
+
+func TestStacksDistinctByLocation(t *testing.T) {
+	first := Stack{
+		{Function: "main.run.func1", File: "main.go", Line: 14},
+		{Function: "main.main", File: "main.go", Line: 3},
+	}
+	second := Stack{
+		{Function: "main.run.func2", File: "main.go", Line: 14},
+		{Function: "main.main", File: "main.go", Line: 3},
+	}
+	stacks := Stacks{first, second, otherStack}
+	if n := len(stacks.Distinct()); n != 3 {
+		t.Fatalf("expected Distinct to keep all 3 stacks, got %d", n)
+	}
+	if distinct := stacks.DistinctByLocation(); !reflect.DeepEqual(distinct, Stacks{first, otherStack}) {
+		t.Fatalf("expected the stacks at the same location to be collapsed, got %v", distinct)
+	}
+}
+
+func TestStacksOriginatesInFile(t *testing.T) {
+	stacks := Stacks{childStack, otherStack}
+	if !stacks.OriginatesInFile("inner") {
+		t.Fatal("expected the error to originate in inner.go")
+	}
+	// Only the top frame of the newest stack is checked
+	if stacks.OriginatesInFile("main.go") || stacks.OriginatesInFile("other.go") {
+		t.Fatal("expected only the origin to be checked")
+	}
+	if (Stacks{}).OriginatesInFile("") || (Stacks{Stack{}}).OriginatesInFile("") {
+		t.Fatal("expected no origin without stacks")
+	}
+}
+
+func TestStacksMap(t *testing.T) {
+	stacks := Stacks{
+		{{Function: "app.handle", File: "/build/src/app/handle.go", Line: 8}},
+		{{Function: "app.query", File: "/build/src/app/db.go", Line: 21}, {Function: "ext.Do", File: "/go/pkg/ext/do.go", Line: 5}},
+	}
+	mapped := stacks.Map(func(frame runtime.Frame) runtime.Frame {
+		frame.File = strings.TrimPrefix(frame.File, "/build/src/")
+		return frame
+	})
+	expected := Stacks{
+		{{Function: "app.handle", File: "app/handle.go", Line: 8}},
+		{{Function: "app.query", File: "app/db.go", Line: 21}, {Function: "ext.Do", File: "/go/pkg/ext/do.go", Line: 5}},
+	}
+	if !reflect.DeepEqual(mapped, expected) {
+		t.Fatalf("expected %v, got %v", expected, mapped)
+	}
+	if stacks[0][0].File != "/build/src/app/handle.go" || stacks[1][0].File != "/build/src/app/db.go" {
+		t.Fatal("expected the original stacks not to be changed")
+	}
+}
+
+func TestTrimTestFrames(t *testing.T) {
+	stack := Stack{
+		{Function: "app.TestHandle", File: "/src/app/handle_test.go", Line: 12},
+		{Function: "testing.tRunner", File: "/go/src/testing/testing.go", Line: 1595},
+		{Function: "runtime.goexit", File: "/go/src/runtime/asm_amd64.s", Line: 1650},
+	}
+	if formatted := stack.Format(); !strings.Contains(formatted, "testing.tRunner") {
+		t.Fatalf("expected the testing frames by default, got %q", formatted)
+	}
+
+	defer SetTrimTestFrames(false)
+	SetTrimTestFrames(true)
+	if formatted := stack.Format(); formatted != "app.TestHandle\n\t/src/app/handle_test.go:12" {
+		t.Fatalf("expected the testing frames to be trimmed, got %q", formatted)
+	}
+	if b, _ := json.Marshal(stack); strings.Contains(string(b), "testing.") {
+		t.Fatalf("expected the testing frames to be trimmed, got %s", b)
+	}
+}
+
+func TestParseTestifyTraces(t *testing.T) {
+	output := "    handler_test.go:42: \n" +
+		"        \tError Trace:\t/src/app/handler_test.go:42\n" +
+		"        \t            \t/src/app/helpers_test.go:17\n" +
+		"        \tError:      \tShould be true\n" +
+		"        \tTest:       \tTestHandler\n"
+	expected := Stacks{{
+		{File: "/src/app/handler_test.go", Line: 42},
+		{File: "/src/app/helpers_test.go", Line: 17},
+	}}
+	if stacks := ParseStacks(output); !reflect.DeepEqual(stacks, expected) {
+		t.Fatalf("expected %v, got %v", expected, stacks)
+	}
+}
+
+func TestStackFromPCs(t *testing.T) {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(1, pcs)
+	stack := StackFromPCs(pcs[:n])
+	if top, ok := stack.Top(); !ok || top.Function != packageFunctionPrefix+"TestStackFromPCs" {
+		t.Fatalf("expected the test function as the top frame, got %v", top)
+	}
+	if !strings.HasSuffix(stack[0].File, "stack_test.go") || stack[0].Line == 0 {
+		t.Fatalf("expected the test file and line, got %v", stack[0])
+	}
+	if len(StackFromPCs(nil)) != 0 {
+		t.Fatal("expected an empty stack")
+	}
+}
+
+func TestStackFormatDelimited(t *testing.T) {
+	stack := Stack{
+		{Function: "pkg.(*T).M", File: "/src/a,b/t.go", Line: 3},
+		{Function: "main.main", File: "/src/main.go", Line: 10},
+	}
+	expected := "function,file,line\n" +
+		"pkg.(*T).M,\"/src/a,b/t.go\",3\n" +
+		"main.main,/src/main.go,10\n"
+	if formatted, err := stack.FormatDelimited(','); err != nil || formatted != expected {
+		t.Fatalf("expected %q, got %q (%v)", expected, formatted, err)
+	}
+	expected = "function\tfile\tline\n" +
+		"pkg.(*T).M\t/src/a,b/t.go\t3\n" +
+		"main.main\t/src/main.go\t10\n"
+	if formatted, err := stack.FormatDelimited('\t'); err != nil || formatted != expected {
+		t.Fatalf("expected %q, got %q (%v)", expected, formatted, err)
+	}
+	for _, sep := range []rune{0, '\n', '\r', '"', utf8.RuneError, -1} {
+		if _, err := stack.FormatDelimited(sep); err == nil {
+			t.Fatalf("expected an error for the separator %q", sep)
+		}
+	}
+}
+
+func TestIncludeFramePackage(t *testing.T) {
+	stack := Stack{
+		{Function: "github.com/x/y/z.(*T).M", File: "/src/z/t.go", Line: 3},
+		{Function: "github.com/x/y/z.Func", File: "/src/z/f.go", Line: 8},
+		{Function: "github.com/x/y/z.Map[go.shape.*github.com/a/b.T]", File: "/src/z/m.go", Line: 5},
+		{Function: "main.main", File: "/src/main.go", Line: 10},
+	}
+	b, err := json.Marshal(stack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"package"`) {
+		t.Fatalf("expected no package field by default, got %s", b)
+	}
+
+	defer SetIncludeFramePackage(false)
+	SetIncludeFramePackage(true)
+	b, err = json.Marshal(stack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := []struct {
+		Package string `json:"package"`
+	}{}
+	if err := json.Unmarshal(b, &frames); err != nil || len(frames) != 4 {
+		t.Fatalf("expected 4 frames, got %s", b)
+	}
+	expected := []string{"github.com/x/y/z", "github.com/x/y/z", "github.com/x/y/z", "main"}
+	for i, frame := range frames {
+		if frame.Package != expected[i] {
+			t.Fatalf("expected frame %d to have package %q, got %q", i, expected[i], frame.Package)
+		}
+	}
+	// The human-readable format is unchanged
+	if strings.Contains(stack.Format(), "package") {
+		t.Fatal("expected no package in the formatted stack")
+	}
+}
+
+func TestParseStacksWithLimit(t *testing.T) {
+	valid := childStack.Format()
+	oversized := "pkg.huge\n\t/src/" + strings.Repeat("x", 4096) + ".go:1"
+	input := valid + "\n\n" + oversized
+	stacks := ParseStacksWithLimit(input, 1024)
+	if len(stacks) != 1 || !stacks[0].Equal(childStack) {
+		t.Fatalf("expected only the valid stack, got %v", stacks)
+	}
+	// Without a limit, the oversized block is parsed too
+	if stacks := ParseStacks(input); len(stacks) != 2 {
+		t.Fatalf("expected 2 stacks, got %d", len(stacks))
+	}
+}
+
+func TestStacksWriteTo(t *testing.T) {
+	stacks := Stacks{childStack, recursiveStack(20), otherStack}
+	buf := &strings.Builder{}
+	n, err := stacks.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != stacks.Format() || n != int64(buf.Len()) {
+		t.Fatalf("expected %q (%d bytes), got %q (%d bytes)", stacks.Format(), len(stacks.Format()), buf.String(), n)
+	}
+
+	buf.Reset()
+	n, err = childStack.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != childStack.Format() || n != int64(buf.Len()) {
+		t.Fatalf("expected %q, got %q", childStack.Format(), buf.String())
+	}
+}
+
+func BenchmarkStacksWriteTo(b *testing.B) {
+	stacks := make(Stacks, 50)
+	for i := range stacks {
+		stacks[i] = recursiveStack(50)
+	}
+	b.Run("WriteTo", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			stacks.WriteTo(io.Discard)
+		}
+	})
+	b.Run("Format", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.WriteString(io.Discard, stacks.Format())
+		}
+	})
+}
+
+func TestStackTopAndBottom(t *testing.T) {
+	if _, ok := (Stack{}).Top(); ok {
+		t.Fatal("expected no top frame for an empty stack")
+	}
+	if _, ok := (Stack{}).Bottom(); ok {
+		t.Fatal("expected no bottom frame for an empty stack")
+	}
+
+	top, ok := otherStack.Top()
+	bottom, bottomOk := otherStack.Bottom()
+	if !ok || !bottomOk || top != otherStack[0] || bottom != otherStack[0] {
+		t.Fatalf("expected the only frame as the top and bottom, got %v and %v", top, bottom)
+	}
+
+	// Trimmed runtime frames aren't the bottom
+	stack := append(append(Stack{}, childStack...), runtime.Frame{Function: "runtime.main", File: "proc.go", Line: 250})
+	if top, ok := stack.Top(); !ok || top != childStack[0] {
+		t.Fatalf("expected %v as the top frame, got %v", childStack[0], top)
+	}
+	if bottom, ok := stack.Bottom(); !ok || bottom != childStack[1] {
+		t.Fatalf("expected %v as the bottom frame, got %v", childStack[1], bottom)
+	}
+}
+
+func TestStackFromEntries(t *testing.T) {
+	stack := StackFromEntries([]StackEntry{
+		{Function: "pkg.inner", File: "inner.go", Line: 5},
+		{Function: "main.main", File: "main.go", Line: 10},
+	})
+	if !reflect.DeepEqual(stack, childStack) {
+		t.Fatalf("expected %v, got %v", childStack, stack)
+	}
+	if formatted := stack.Format(); formatted != childStack.Format() {
+		t.Fatalf("unexpected formatted stack %q", formatted)
+	}
+	b, err := json.Marshal(stack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `[{"function":"pkg.inner","file":"inner.go","line":5},{"function":"main.main","file":"main.go","line":10}]`; string(b) != expected {
+		t.Fatalf("expected %s, got %s", expected, b)
+	}
+	if err := WrapWithStack(errors.New("no such host"), stack); !err.Stacks()[0].Equal(stack) {
+		t.Fatalf("expected the built stack, got %v", err.Stacks())
+	}
+}
+
+func TestStacksGroupByOrigin(t *testing.T) {
+	// Two stacks from the same origin, reached through different callers
+	viaMain := childStack
+	viaWorker := Stack{childStack[0], {Function: "main.worker", File: "main.go", Line: 30}}
+	groups := Stacks{viaMain, otherStack, viaWorker, {}}.GroupByOrigin()
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got %v", groups)
+	}
+	if group := groups["pkg.inner@inner.go:5"]; !group.Equal(Stacks{viaMain, viaWorker}) {
+		t.Fatalf("expected both stacks from pkg.inner in order, got %v", group)
+	}
+	if group := groups["pkg.other@other.go:7"]; !group.Equal(Stacks{otherStack}) {
+		t.Fatalf("expected the stack from pkg.other, got %v", group)
+	}
+}
+
+func TestStacksFirstAppFrame(t *testing.T) {
+	app := runtime.Frame{Function: "github.com/org/app/service.Load", File: "/src/app/service/load.go", Line: 21}
+	stacks := Stacks{{
+		{Function: "net.(*Dialer).DialContext", File: "/go/src/net/dial.go", Line: 500},
+		{Function: "github.com/lib/pq.(*conn).Open", File: "/mod/pq/conn.go", Line: 88},
+		app,
+		{Function: "github.com/org/app/cmd.main", File: "/src/app/cmd/main.go", Line: 9},
+	}}
+	if frame, ok := stacks.FirstAppFrame("github.com/other/", "github.com/org/app/"); !ok || frame != app {
+		t.Fatalf("expected %v, got %v", app, frame)
+	}
+	if _, ok := stacks.FirstAppFrame("github.com/other/"); ok {
+		t.Fatal("expected no frame without a matching prefix")
+	}
+	if _, ok := stacks.FirstAppFrame(); ok {
+		t.Fatal("expected no frame without any prefixes")
+	}
+}
+
+func TestStackTruncate(t *testing.T) {
+	deep := recursiveStack(80)
+	truncated := deep.Truncate(3)
+	if len(truncated) != 4 || !reflect.DeepEqual(truncated[:3], deep[:3]) {
+		t.Fatalf("expected the newest 3 frames and a marker, got %v", truncated)
+	}
+	if truncated[3].Function != "...(truncated)" {
+		t.Fatalf("expected a truncation marker, got %v", truncated[3])
+	}
+	if formatted := truncated.Format(); !strings.HasSuffix(formatted, "\n...(truncated)") {
+		t.Fatalf("expected the marker to be formatted on its own, got %q", formatted)
+	}
+	if len(deep) != 82 {
+		t.Fatal("expected the original stack not to be changed")
+	}
+	// Stacks that are short enough are unchanged
+	if shallow := childStack.Truncate(2); !reflect.DeepEqual(shallow, childStack) {
+		t.Fatalf("expected the stack to be unchanged, got %v", shallow)
+	}
+
+	stacks := Stacks{deep, childStack}.TruncateDepth(2)
+	if len(stacks) != 2 || len(stacks[0]) != 3 || !reflect.DeepEqual(stacks[1], childStack) {
+		t.Fatalf("expected each stack to be truncated, got %v", stacks)
+	}
+}
+
+func TestStackFormatWithSource(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "main.go")
+	source := "package main\n\nfunc main() {\n\tpanic(\"failed\")\n}\n"
+	if err := os.WriteFile(file, []byte(source), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stack := Stack{{Function: "main.main", File: file, Line: 4}}
+	expected := stack.Format() + "\n" +
+		"\t\t      3 | func main() {\n" +
+		"\t\t>     4 | \tpanic(\"failed\")\n" +
+		"\t\t      5 | }"
+	if formatted := stack.FormatWithSource(root, 1); formatted != expected {
+		t.Fatalf("expected %q, got %q", expected, formatted)
+	}
+
+	// Frames whose source files can't be read are formatted normally
+	missing := Stack{{Function: "main.main", File: filepath.Join(root, "missing.go"), Line: 4}}
+	if formatted := missing.FormatWithSource(root, 1); formatted != missing.Format() {
+		t.Fatalf("expected the plain format, got %q", formatted)
+	}
+
+	// Files outside of the root aren't read, even through a symlink
+	other := t.TempDir()
+	if formatted := stack.FormatWithSource(other, 1); formatted != stack.Format() {
+		t.Fatalf("expected the plain format for a file outside of the root, got %q", formatted)
+	}
+	escaping := Stack{{Function: "main.main", File: filepath.Join(other, "..", filepath.Base(root), "main.go"), Line: 4}}
+	if formatted := escaping.FormatWithSource(other, 1); formatted != escaping.Format() {
+		t.Fatalf("expected the plain format for a path that leaves the root, got %q", formatted)
+	}
+	link := filepath.Join(other, "main.go")
+	if err := os.Symlink(file, link); err == nil {
+		linked := Stack{{Function: "main.main", File: link, Line: 4}}
+		if formatted := linked.FormatWithSource(other, 1); formatted != linked.Format() {
+			t.Fatalf("expected the plain format for a symlink out of the root, got %q", formatted)
+		}
+	}
+}
+
+func TestParseStacksReader(t *testing.T) {
+	b, err := json.Marshal(Stacks{childStack, otherStack})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := map[string]string{
+		"console": "some log output\n\n" + childStack.Format() + "\n\n\n" + otherStack.Format() + "\r\n",
+		"json":    "  " + string(b),
+		"testify": "\tError Trace:\t/src/app/handler_test.go:42\n\tError:      \tShould be true\n",
+		"empty":   "",
+	}
+	for name, input := range inputs {
+		stacks, err := ParseStacksReader(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if expected := ParseStacks(input); !reflect.DeepEqual(stacks, expected) {
+			t.Fatalf("%s: expected %v, got %v", name, expected, stacks)
+		}
+	}
+}
+
+func TestParseStacksReaderErrors(t *testing.T) {
+	if _, err := ParseStacksReader(strings.NewReader(`[[{"function":`)); err == nil {
+		t.Fatal("expected an error for invalid JSON")
+	}
+	// Noise without any blank lines can't grow the block without a limit
+	noise := "INFO request handled " + strings.Repeat("x", 1000) + "\n"
+	input := &repeatReader{s: noise, remaining: 2 * maxParseBlockBytes}
+	if _, err := ParseStacksReader(input); err == nil || !strings.Contains(err.Error(), "blank line") {
+		t.Fatalf("expected an error for a block that is too long, got %v", err)
+	}
+	if input.remaining < maxParseBlockBytes/2 {
+		t.Fatalf("expected parsing to stop at the limit, but %d bytes were left", input.remaining)
+	}
+}
+
+// repeatReader repeats a string until a number of bytes has been read, without
+// holding the whole input in memory
+type repeatReader struct {
+	s         string
+	remaining int
+	offset    int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && r.remaining > 0 {
+		c := copy(p[n:], r.s[r.offset:])
+		if c > r.remaining {
+			c = r.remaining
+		}
+		n += c
+		r.remaining -= c
+		r.offset = (r.offset + c) % len(r.s)
+	}
+	return n, nil
+}
+
+func TestParseStacksReaderBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("parses a large input")
+	}
+	const inputBytes = 16 * 1024 * 1024
+	noise := "INFO request handled " + strings.Repeat("x", 1000) + "\n\n"
+	input := io.MultiReader(
+		&repeatReader{s: noise, remaining: inputBytes - inputBytes%len(noise)},
+		strings.NewReader(childStack.Format()),
+	)
+
+	// Sample the heap while parsing, to check that the input isn't buffered in full
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var max uint64
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				peak <- max
+				return
+			case <-time.After(10 * time.Millisecond):
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > max {
+					max = stats.HeapAlloc
+				}
+			}
+		}
+	}()
+	stacks, err := ParseStacksReader(input)
+	close(done)
+	max := <-peak
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stacks) != 1 || !stacks[0].Equal(childStack) {
+		t.Fatalf("expected the stack at the end of the input, got %v", stacks)
+	}
+	if max > before.HeapAlloc && max-before.HeapAlloc > inputBytes/2 {
+		t.Fatalf("expected bounded memory use for %d bytes of input, but the heap grew by %d bytes", inputBytes, max-before.HeapAlloc)
+	}
+}
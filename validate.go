@@ -0,0 +1,40 @@
+package stackerr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Validate checks the internal invariants of the first stackerr.Error in an error's
+// chain, e.g. after reconstructing it from JSON or parsed stacks. It returns an error
+// that describes every violation, or nil if there are none (or if there is no
+// stackerr.Error in the chain). The invariants are that it wraps a non-nil error,
+// that none of its stacks are empty, and that none of its stacks are duplicates.
+// Stacks that are the parent of another one are allowed, since they're kept by
+// WrapKeepingAllStacks, WrapLabeled, and when SetCollapseParentStacks is disabled.
+func Validate(err error) error {
+	var serr *stackError
+	if !errors.As(err, &serr) {
+		return nil
+	}
+	var violations []error
+	if serr.Err == nil {
+		violations = append(violations, errors.New("stackerr: wrapped error is nil"))
+	}
+	stacks := serr.resolvedStacks()
+	// Stacks that can't be retrieved from the stack store aren't compared to other stacks
+	missing := func(i int) bool {
+		return len(stacks[i]) == 0 && serr.StackMetas.isStored(i)
+	}
+	for i, stack := range stacks {
+		if missing(i) {
+			violations = append(violations, fmt.Errorf("stackerr: stack %d can't be retrieved from the stack store", i))
+		} else if len(stack.trimStack()) == 0 {
+			violations = append(violations, fmt.Errorf("stackerr: stack %d has no frames", i))
+		}
+	}
+	if distinct := stacks.distinctIndices(missing); len(distinct) != len(stacks) {
+		violations = append(violations, fmt.Errorf("stackerr: %d of %d stacks are duplicates", len(stacks)-len(distinct), len(stacks)))
+	}
+	return errors.Join(violations...)
+}
@@ -0,0 +1,87 @@
+package stackerr
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateWellFormed(t *testing.T) {
+	if err := Validate(nil); err != nil {
+		t.Fatalf("expected no violations for a nil error, got %v", err)
+	}
+	if err := Validate(errors.New("rate limited")); err != nil {
+		t.Fatalf("expected no violations without a stackerr.Error, got %v", err)
+	}
+	wrapped := Wrap(wrapInHelper(errors.New("rate limited"))).WithSingle("key", "value")
+	if err := Validate(wrapped); err != nil {
+		t.Fatalf("expected no violations, got %v", err)
+	}
+
+	// An error reconstructed from JSON is still well-formed
+	b, err := wrapped.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshaled := &stackError{}
+	if err := json.Unmarshal(b, unmarshaled); err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(unmarshaled); err != nil {
+		t.Fatalf("expected no violations after a JSON round trip, got %v", err)
+	}
+}
+
+func TestValidateViolations(t *testing.T) {
+	violations := map[string]*stackError{
+		"wrapped error is nil":         {StackTraces: Stacks{childStack}},
+		"stack 1 has no frames":        {Err: errors.New("checksum mismatch"), StackTraces: Stacks{childStack, {}}},
+		"1 of 3 stacks are duplicates": {Err: errors.New("checksum mismatch"), StackTraces: Stacks{childStack, otherStack, childStack}},
+	}
+	for violation, serr := range violations {
+		err := Validate(serr)
+		if err == nil || !strings.Contains(err.Error(), violation) {
+			t.Fatalf("expected %q to be reported, got %v", violation, err)
+		}
+	}
+
+	// Every violation is reported
+	err := Validate(&stackError{StackTraces: Stacks{{}, childStack, childStack}})
+	if err == nil || strings.Count(err.Error(), "\n") != 2 {
+		t.Fatalf("expected 3 violations, got %v", err)
+	}
+
+	// Parents of other stacks are allowed
+	parents := &stackError{Err: errors.New("checksum mismatch"), StackTraces: Stacks{parentStack, childStack}}
+	if err := Validate(parents); err != nil {
+		t.Fatalf("expected no violations, got %v", err)
+	}
+}
+
+func TestValidateKeepingAllStacks(t *testing.T) {
+	kept := WrapKeepingAllStacks(wrapInHelper(errors.New("checksum mismatch")))
+	if len(kept.Stacks()) != 2 || !kept.Stacks()[0].IsParentOf(kept.Stacks()[1]) {
+		t.Fatalf("expected the parent stack to be kept, got %v", kept.Stacks())
+	}
+	if err := Validate(kept); err != nil {
+		t.Fatalf("expected no violations, got %v", err)
+	}
+}
+
+func TestValidateLabeledAndStoredStacks(t *testing.T) {
+	labeled := WrapLabeled("handler", wrapLabeledInHelper("repository", errors.New("record not found")))
+	if err := Validate(labeled); err != nil {
+		t.Fatalf("expected no violations for labeled layers, got %v", err)
+	}
+
+	store := useStackStore(t)
+	stored := wrapInHelper(Wrap(errors.New("upstream unavailable")))
+	if err := Validate(stored); err != nil {
+		t.Fatalf("expected no violations for offloaded parents, got %v", err)
+	}
+	store.failGet = true
+	if Validate(stored) == nil {
+		t.Fatal("expected a missing stack to be reported")
+	}
+}